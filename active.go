@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+)
+
+const defaultActiveCheckDelay = 60
+
+// ActiveCheck defines the items served to zabbix agents in active mode
+type ActiveCheck struct {
+	// Keys are the full item keys requested from the agents. Defaults to the
+	// metric zabbix_key if the metric has no args.
+	Keys []string `json:"keys"`
+	// Delay is the update interval in seconds
+	Delay int `json:"delay"`
+	// Hosts are glob patterns of the hosts the checks are served to. All
+	// hosts get the checks if empty.
+	Hosts []string `json:"hosts"`
+}
+
+// activeCheckItem is an item in an "active checks" response
+type activeCheckItem struct {
+	Key         string `json:"key"`
+	Delay       int    `json:"delay"`
+	LastLogSize int    `json:"lastlogsize"`
+	MTime       int    `json:"mtime"`
+}
+
+// init validates the active checks of metric and fills in the defaults
+func (a *ActiveCheck) init(metric *Metric) error {
+	if len(a.Keys) == 0 {
+		if len(metric.Args) > 0 || metric.keyRegexp != nil {
+			return errors.New("keys are required for metrics with args or key patterns")
+		}
+		a.Keys = []string{metric.ZabbixKey}
+	}
+
+	for _, key := range a.Keys {
+		k, err := ParseItemKey(key)
+		if err != nil {
+			return err
+		}
+		if _, ok := metric.match(k); !ok {
+			return fmt.Errorf("key %s does not match %s", key, metric.keyDescription())
+		}
+	}
+
+	if a.Delay < 0 {
+		return fmt.Errorf("invalid delay: %d", a.Delay)
+	}
+	if a.Delay == 0 {
+		a.Delay = defaultActiveCheckDelay
+	}
+
+	for _, pattern := range a.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %s: %v", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// matchHost reports whether the checks are served to host
+func (a *ActiveCheck) matchHost(host string) bool {
+	if len(a.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range a.Hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// activeChecks returns the items an agent running on host has to collect
+func (s *ZServer) activeChecks(host string) []activeCheckItem {
+	items := []activeCheckItem{}
+	for _, metric := range s.currentMetrics().metrics {
+		if metric.Active == nil || !metric.Active.matchHost(host) {
+			continue
+		}
+		for _, key := range metric.Active.Keys {
+			items = append(items, activeCheckItem{Key: key, Delay: metric.Active.Delay})
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+
+	return items
+}
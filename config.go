@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"sigs.k8s.io/yaml"
+)
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// listenerSettings are the per listener settings, named as the server.*
+// flags they default to
+var listenerSettings = []string{
+	"listen-address",
+	"listen-port",
+	"ip-whitelist",
+	"tls-cert-file",
+	"tls-key-file",
+	"tls-ca-file",
+	"tls-require-client-cert",
+	"tls-accept",
+	"tls-subject",
+	"tls-issuer",
+}
+
+// expandEnv replaces the ${VAR} references of a config value with the value
+// of the environment variables. Undefined variables are an error so a missing
+// secret is not silently replaced with an empty string. Values are expanded
+// after parsing so they cannot change the structure of the file.
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined environment variables: %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// configValue converts a config file value to its flag representation
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return expandEnv(v)
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, e := range v {
+			value, err := configValue(e)
+			if err != nil {
+				return "", err
+			}
+			values[i] = value
+		}
+		return strings.Join(values, ","), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// flattenConfig converts nested config sections into flag names, e.g.
+// {"server": {"listen-port": 10051}} into "server.listen-port": "10051"
+func flattenConfig(prefix string, section map[string]interface{}, settings map[string]string) error {
+	for key, v := range section {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+
+		if sub, ok := v.(map[string]interface{}); ok {
+			if err := flattenConfig(name, sub, settings); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		settings[name] = value
+	}
+	return nil
+}
+
+// loadConfigFile applies the settings of a YAML config file to the flags
+// that were not set on the command line or in the environment, and returns
+// the settings of the listeners it defines
+func loadConfigFile(c *cli.Context, file string) ([]map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse config file: %v", err)
+	}
+
+	var listeners []map[string]string
+	if raw, ok := config["listeners"]; ok {
+		delete(config, "listeners")
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, errors.New("listeners must be a list")
+		}
+		for i, l := range list {
+			section, ok := l.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("listeners[%d] must be a map", i)
+			}
+			settings := make(map[string]string)
+			if err := flattenConfig("", section, settings); err != nil {
+				return nil, fmt.Errorf("listeners[%d]: %v", i, err)
+			}
+			for name := range settings {
+				if !isListenerSetting(name) {
+					return nil, fmt.Errorf("listeners[%d]: unknown setting %s", i, name)
+				}
+			}
+			listeners = append(listeners, settings)
+		}
+	}
+
+	settings := make(map[string]string)
+	if err := flattenConfig("", config, settings); err != nil {
+		return nil, err
+	}
+
+	flags := make(map[string]bool)
+	for _, f := range c.App.Flags {
+		for _, name := range f.Names() {
+			flags[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !flags[name] || name == "config.file" {
+			return nil, fmt.Errorf("unknown setting %s", name)
+		}
+		// flags and environment variables take precedence
+		if c.IsSet(name) {
+			continue
+		}
+		if err := c.Set(name, settings[name]); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+
+	return listeners, nil
+}
+
+func isListenerSetting(name string) bool {
+	for _, s := range listenerSettings {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPWhitelist splits a list of comma separated IPs and CIDRs
+func parseIPWhitelist(list []string) ([]*net.IP, []*net.IPNet, error) {
+	var ipWhitelist []*net.IP
+	var cidrWhitelist []*net.IPNet
+	for _, iparg := range list {
+		ips := strings.Split(iparg, ",")
+		for _, ip := range ips {
+			if strings.Contains(ip, "/") {
+				_, ipnet, err := net.ParseCIDR(ip)
+				if err != nil {
+					return nil, nil, fmt.Errorf("could not parse CIDR: %v", err)
+				}
+				cidrWhitelist = append(cidrWhitelist, ipnet)
+			} else {
+				if parsedIP := net.ParseIP(ip); parsedIP != nil {
+					ipWhitelist = append(ipWhitelist, &parsedIP)
+				} else {
+					return nil, nil, fmt.Errorf("could not parse IP: %s", ip)
+				}
+			}
+		}
+	}
+	return ipWhitelist, cidrWhitelist, nil
+}
+
+// newListenerConfig builds a listener from its settings
+func newListenerConfig(settings map[string]string) (*ListenerConfig, error) {
+	port, err := strconv.ParseInt(settings["listen-port"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen-port: %v", err)
+	}
+
+	c := &ListenerConfig{
+		ListenAddress: settings["listen-address"],
+		ListenPort:    port,
+	}
+	c.IPWhitelist, c.CIDRWhitelist, err = parseIPWhitelist([]string{settings["ip-whitelist"]})
+	if err != nil {
+		return nil, err
+	}
+
+	if settings["tls-cert-file"] != "" {
+		requireCert, err := strconv.ParseBool(settings["tls-require-client-cert"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls-require-client-cert: %v", err)
+		}
+		c.TLS = &TLSConfig{
+			CertFile:          settings["tls-cert-file"],
+			KeyFile:           settings["tls-key-file"],
+			CAFile:            settings["tls-ca-file"],
+			RequireClientCert: requireCert,
+			Accept:            strings.Split(settings["tls-accept"], ","),
+			Subject:           settings["tls-subject"],
+			Issuer:            settings["tls-issuer"],
+		}
+	}
+
+	return c, nil
+}
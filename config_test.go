@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+// runWithConfig runs an app with a few flags of each type on args after
+// loading the config file, and returns their values
+func runWithConfig(t *testing.T, file string, args ...string) (map[string]string, []map[string]string, error) {
+	t.Helper()
+	values := make(map[string]string)
+	var listeners []map[string]string
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config.file"},
+			&cli.IntFlag{Name: "server.listen-port", Value: 10051, EnvVars: []string{"ZI_TEST_LISTEN_PORT"}},
+			&cli.StringFlag{Name: "server.listen-address", Value: "0.0.0.0"},
+			&cli.StringSliceFlag{Name: "server.ip-whitelist", Value: cli.NewStringSlice("0.0.0.0/0")},
+			&cli.BoolFlag{Name: "metrics.last-seen"},
+			&cli.StringFlag{Name: "metrics.namespace", Value: "zabbix_impersonator", EnvVars: []string{"ZI_TEST_NAMESPACE"}},
+		},
+		Action: func(c *cli.Context) error {
+			var err error
+			if listeners, err = loadConfigFile(c, file); err != nil {
+				return err
+			}
+			values["server.listen-port"] = c.String("server.listen-port")
+			values["server.listen-address"] = c.String("server.listen-address")
+			values["server.ip-whitelist"] = strings.Join(c.StringSlice("server.ip-whitelist"), ",")
+			values["metrics.last-seen"] = c.String("metrics.last-seen")
+			values["metrics.namespace"] = c.String("metrics.namespace")
+			return nil
+		},
+	}
+	err := app.Run(append([]string{"zi"}, args...))
+	return values, listeners, err
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, "config.yaml", `
+server:
+  listen-port: 20051
+  listen-address: ${ZI_TEST_ADDRESS}
+  ip-whitelist: [10.0.0.0/8, "${ZI_TEST_IP}"]
+metrics:
+  last-seen: true
+  namespace: from_file
+listeners:
+- listen-port: 20052
+  tls-cert-file: /etc/${ZI_TEST_IP}.pem
+`)
+
+	os.Setenv("ZI_TEST_ADDRESS", "127.0.0.1")
+	os.Setenv("ZI_TEST_IP", "192.168.0.1")
+	os.Setenv("ZI_TEST_NAMESPACE", "from_env")
+	defer func() {
+		for _, name := range []string{"ZI_TEST_ADDRESS", "ZI_TEST_IP", "ZI_TEST_NAMESPACE"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	// flags then environment variables take precedence over the file
+	values, listeners, err := runWithConfig(t, file, "--server.listen-port", "30051")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"server.listen-port":    "30051",
+		"server.listen-address": "127.0.0.1",
+		"server.ip-whitelist":   "10.0.0.0/8,192.168.0.1",
+		"metrics.last-seen":     "true",
+		"metrics.namespace":     "from_env",
+	} {
+		if values[name] != want {
+			t.Errorf("%s = %s, want %s", name, values[name], want)
+		}
+	}
+	if len(listeners) != 1 || listeners[0]["listen-port"] != "20052" || listeners[0]["tls-cert-file"] != "/etc/192.168.0.1.pem" {
+		t.Errorf("listeners = %v", listeners)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	os.Unsetenv("ZI_TEST_MISSING")
+
+	for _, tc := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"unknown", "server:\n  port: 1", "unknown setting server.port"},
+		{"config file", "config:\n  file: other.yaml", "unknown setting config.file"},
+		{"invalid", "server:\n  listen-port: high", "invalid value for server.listen-port"},
+		{"undefined variable", "metrics:\n  namespace: ${ZI_TEST_MISSING}", "metrics.namespace: undefined environment variables: ZI_TEST_MISSING"},
+		{"listeners list", "listeners: {}", "listeners must be a list"},
+		{"listener setting", "listeners:\n- metrics.namespace: x", "listeners[0]: unknown setting metrics.namespace"},
+		{"syntax", "server: [", "could not parse config file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := runWithConfig(t, writeFile(t, dir, "config.yaml", tc.data))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
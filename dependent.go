@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// definitions returns the metric followed by its dependent metrics and item
+// prototypes
+func (m *Metric) definitions() []*Metric {
+	return append(append([]*Metric{m}, m.Dependent...), m.Prototypes...)
+}
+
+// initDependent validates a dependent metric of master and creates its
+// collector. Dependent metrics share the labels of their master.
+func (s *ZServer) initDependent(master, dep *Metric) error {
+	if dep.ZabbixKey != "" || dep.ZabbixKeyGlob != "" || dep.ZabbixKeyRegex != "" ||
+		len(dep.Args) > 0 || len(dep.MatchArgs) > 0 || len(dep.Defaults) > 0 ||
+		dep.Active != nil || len(dep.Dependent) > 0 {
+		return errors.New("dependent metrics cannot define keys, args, active checks or dependent metrics")
+	}
+	if dep.Metric == "" {
+		return errors.New("dependent metrics require a metric name")
+	}
+	if dep.Kind == "" {
+		return fmt.Errorf("missing metric kind in config for metric %s", dep.Metric)
+	}
+
+	var err error
+	if dep.path, err = parseJSONPath(dep.Path); err != nil {
+		return fmt.Errorf("invalid path %q: %v", dep.Path, err)
+	}
+	if dep.ValuePath != "" {
+		if dep.valuePath, err = parseJSONPath(dep.ValuePath); err != nil {
+			return fmt.Errorf("invalid value_path %q: %v", dep.ValuePath, err)
+		}
+	}
+	if !dep.path.definite() && len(dep.ElementLabels) == 0 {
+		return fmt.Errorf("path %s can match several values, element_labels are required to tell them apart", dep.Path)
+	}
+
+	dep.elementLabels = nil
+	dep.elementPaths = make(map[string]*jsonPath)
+	for name, path := range dep.ElementLabels {
+		if dep.elementPaths[name], err = parseJSONPath(path); err != nil {
+			return fmt.Errorf("invalid path %q for element label %s: %v", path, name, err)
+		}
+		dep.elementLabels = append(dep.elementLabels, name)
+	}
+	sort.Strings(dep.elementLabels)
+
+	dep.master = master
+	dep.Args = master.Args
+	dep.MatchArgs = master.MatchArgs
+	dep.captures = master.captures
+	if dep.Namespace == "" {
+		dep.Namespace = master.Namespace
+	}
+	MetricDefaults{Labels: master.Labels}.apply(dep)
+
+	return s.initCollector(dep)
+}
+
+// updateDependents applies the values extracted from the JSON value of a
+// master item to its dependent metrics. It returns the number of applied
+// values and the errors of the others.
+func (m *Metric) updateDependents(labels []string, text string, ts time.Time) (int, []error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		return 0, []error{fmt.Errorf("invalid JSON value: %v", err)}
+	}
+
+	var applied int
+	var errs []error
+	for _, dep := range m.Dependent {
+		elements, err := dep.path.eval(doc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dependent metric %s: %v", dep.Metric, err))
+			continue
+		}
+		if len(elements) == 0 {
+			errs = append(errs, fmt.Errorf("no data matches %s for dependent metric %s", dep.Path, dep.Metric))
+			continue
+		}
+
+		for _, element := range elements {
+			depLabels, value, err := dep.extractElement(labels, element)
+			if err == nil {
+				err = dep.update(depLabels, value, ts)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("dependent metric %s: %v", dep.Metric, err))
+				continue
+			}
+			applied++
+		}
+	}
+
+	return applied, errs
+}
+
+// extractElement returns the labels and the value of a dependent metric for
+// an element selected by its path
+func (m *Metric) extractElement(labels []string, element interface{}) ([]string, string, error) {
+	depLabels := append(make([]string, 0, len(labels)+len(m.elementLabels)), labels...)
+	for _, name := range m.elementLabels {
+		matches, err := m.elementPaths[name].eval(element)
+		if err != nil {
+			return nil, "", fmt.Errorf("element label %s: %v", name, err)
+		}
+		if len(matches) == 0 {
+			return nil, "", fmt.Errorf("no data matches %s for element label %s", m.ElementLabels[name], name)
+		}
+		depLabels = append(depLabels, jsonText(matches[0]))
+	}
+
+	value := element
+	if m.valuePath != nil {
+		matches, err := m.valuePath.eval(element)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(matches) == 0 {
+			return nil, "", fmt.Errorf("no data matches %s", m.ValuePath)
+		}
+		value = matches[0]
+	}
+
+	return depLabels, jsonText(value), nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// kindDiscovery is the kind of low-level discovery rules
+const kindDiscovery = "discovery"
+
+// defaultKeepLostResources is the zabbix default period lost entities are
+// kept for
+const defaultKeepLostResources = 30 * 24 * time.Hour
+
+var lldMacro = regexp.MustCompile(`\{#[A-Z0-9_.]+\}`)
+
+// discoveredEntity is a row of a discovery value: the values of its macros
+type discoveredEntity struct {
+	macros   map[string]string
+	lastSeen time.Time
+}
+
+// discoveredItem is an item prototype instantiated for an entity
+type discoveredItem struct {
+	prototype *Metric
+	// labels are the values of the prototype macros
+	labels []string
+}
+
+// discoveryState holds the entities discovered by a rule for every host and
+// the items they instantiate
+type discoveryState struct {
+	mu       sync.Mutex
+	entities map[string]map[string]*discoveredEntity
+	// items maps the canonical keys of the instantiated items of every host
+	items map[string]map[string]*discoveredItem
+}
+
+func newDiscoveryState() *discoveryState {
+	return &discoveryState{
+		entities: make(map[string]map[string]*discoveredEntity),
+		items:    make(map[string]map[string]*discoveredItem),
+	}
+}
+
+// canonicalKey identifies an item key independently of its quoting
+func canonicalKey(key ItemKey) string {
+	return key.Name + "\xff" + strings.Join(key.Values(), "\xff")
+}
+
+// macroLabel returns the label exposing a macro: {#FS.NAME} is fs_name
+func macroLabel(macro string) string {
+	return sanitizeKey(strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(macro, "{#"), "}")))
+}
+
+// initDiscovery validates a discovery rule and its item prototypes
+func (s *ZServer) initDiscovery(rule *Metric) error {
+	if len(rule.Prototypes) == 0 {
+		return fmt.Errorf("discovery rule %s requires prototypes", rule.Metric)
+	}
+	if len(rule.Dependent) > 0 || len(rule.Preprocessing) > 0 || len(rule.ValueMap) > 0 {
+		return fmt.Errorf("discovery rule %s cannot define dependent metrics, preprocessing or value_map", rule.Metric)
+	}
+
+	rule.keepLostResources = defaultKeepLostResources
+	if rule.KeepLostResources != "" {
+		keep, err := time.ParseDuration(rule.KeepLostResources)
+		if err != nil || keep < 0 {
+			return fmt.Errorf("invalid keep_lost_resources %q for discovery rule %s", rule.KeepLostResources, rule.Metric)
+		}
+		rule.keepLostResources = keep
+	}
+
+	for i, proto := range rule.Prototypes {
+		if err := s.initPrototype(rule, proto); err != nil {
+			return fmt.Errorf("invalid prototypes[%d] of discovery rule %s: %v", i, rule.Metric, err)
+		}
+	}
+
+	rule.discovery = newDiscoveryState()
+	return nil
+}
+
+// initPrototype validates an item prototype of rule and creates its
+// collector. The macros of its key are exposed as labels.
+func (s *ZServer) initPrototype(rule, proto *Metric) error {
+	if proto.ZabbixKeyGlob != "" || proto.ZabbixKeyRegex != "" ||
+		len(proto.Args) > 0 || len(proto.MatchArgs) > 0 || len(proto.Defaults) > 0 ||
+		proto.Active != nil || len(proto.Dependent) > 0 || len(proto.Prototypes) > 0 {
+		return errors.New("item prototypes cannot define key patterns, args, active checks, dependent metrics or prototypes")
+	}
+	if proto.Metric == "" {
+		return errors.New("item prototypes require a metric name")
+	}
+
+	proto.macros = nil
+	proto.macroLabels = nil
+	seen := make(map[string]bool)
+	for _, macro := range lldMacro.FindAllString(proto.ZabbixKey, -1) {
+		if !seen[macro] {
+			seen[macro] = true
+			proto.macros = append(proto.macros, macro)
+			proto.macroLabels = append(proto.macroLabels, macroLabel(macro))
+		}
+	}
+	if len(proto.macros) == 0 {
+		return fmt.Errorf("key %s does not reference any {#MACRO}", proto.ZabbixKey)
+	}
+
+	key, err := ParseItemKey(proto.ZabbixKey)
+	if err != nil {
+		return err
+	}
+	proto.prototypeKey = key
+
+	if proto.Namespace == "" {
+		proto.Namespace = rule.Namespace
+	}
+	MetricDefaults{Labels: rule.Labels}.apply(proto)
+
+	return s.initCollector(proto)
+}
+
+// instantiate returns the canonical key of the prototype for the macro
+// values of an entity. The macros are replaced in the parsed parameters, so
+// values containing commas, quotes or brackets need no escaping.
+func (m *Metric) instantiate(macros map[string]string) string {
+	expand := func(value string) string {
+		return lldMacro.ReplaceAllStringFunc(value, func(macro string) string {
+			return macros[macro]
+		})
+	}
+
+	key := ItemKey{Name: m.prototypeKey.Name, Params: make([]KeyParam, len(m.prototypeKey.Params))}
+	for i, p := range m.prototypeKey.Params {
+		key.Params[i] = KeyParam{Value: expand(p.Value), IsArray: p.IsArray}
+		for _, e := range p.Array {
+			key.Params[i].Array = append(key.Params[i].Array, expand(e))
+		}
+	}
+	return canonicalKey(key)
+}
+
+// parseDiscoveryValue parses the rows of a discovery value, either an array
+// or an object with the array under "data"
+func parseDiscoveryValue(text string) ([]map[string]string, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		return nil, fmt.Errorf("invalid discovery value: %v", err)
+	}
+	if obj, ok := doc.(map[string]interface{}); ok {
+		doc = obj["data"]
+	}
+	rows, ok := doc.([]interface{})
+	if !ok {
+		return nil, errors.New("invalid discovery value: expected an array of objects")
+	}
+
+	var entities []map[string]string
+	for _, row := range rows {
+		obj, ok := row.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid discovery value: expected an array of objects")
+		}
+		macros := make(map[string]string)
+		for name, value := range obj {
+			if lldMacro.MatchString(name) && lldMacro.FindString(name) == name {
+				macros[name] = jsonText(value)
+			}
+		}
+		entities = append(entities, macros)
+	}
+	return entities, nil
+}
+
+// entityKey identifies an entity by its macro values
+func entityKey(macros map[string]string) string {
+	pairs := make([]string, 0, len(macros))
+	for name, value := range macros {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+// discover applies a discovery value received from host at now: the
+// entities it lists are (re)discovered and the ones that were not discovered
+// for longer than the keep lost resources period are removed with their
+// series
+func (s *ZServer) discover(rule *Metric, host, text string, now time.Time) error {
+	rows, err := parseDiscoveryValue(text)
+	if err != nil {
+		return err
+	}
+
+	d := rule.discovery
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entities := d.entities[host]
+	if entities == nil {
+		entities = make(map[string]*discoveredEntity)
+		d.entities[host] = entities
+	}
+	added := make(map[*discoveredEntity]bool)
+	for _, macros := range rows {
+		key := entityKey(macros)
+		if e, ok := entities[key]; ok {
+			e.lastSeen = now
+			continue
+		}
+		e := &discoveredEntity{macros: macros, lastSeen: now}
+		entities[key] = e
+		added[e] = true
+	}
+
+	for key, e := range entities {
+		if now.Sub(e.lastSeen) > rule.keepLostResources {
+			delete(entities, key)
+		}
+	}
+
+	items := make(map[string]*discoveredItem)
+	for _, e := range entities {
+		for _, proto := range rule.Prototypes {
+			labels := make([]string, len(proto.macros))
+			var missing []string
+			for i, macro := range proto.macros {
+				var ok bool
+				if labels[i], ok = e.macros[macro]; !ok {
+					missing = append(missing, macro)
+				}
+			}
+			if len(missing) > 0 {
+				// logged once, when the entity is discovered
+				if added[e] {
+					log.Warnf("Discovery rule %s: entity %v of host %s does not define %s, prototype %s is not instantiated",
+						rule.Metric, e.macros, host, strings.Join(missing, ", "), proto.ZabbixKey)
+				}
+				continue
+			}
+			items[proto.instantiate(e.macros)] = &discoveredItem{prototype: proto, labels: labels}
+		}
+	}
+
+	// lost items stop being accepted and their series are removed
+	for key, item := range d.items[host] {
+		if _, ok := items[key]; !ok {
+			item.prototype.deleteSeries(append([]string{host}, item.labels...))
+		}
+	}
+	d.items[host] = items
+
+	if len(entities) == 0 {
+		delete(d.entities, host)
+		delete(d.items, host)
+	}
+	s.selfMetrics.discoveryEntities.WithLabelValues(rule.Metric, host).Set(float64(len(entities)))
+
+	return nil
+}
+
+// lookupDiscovered returns the item prototype instantiated for key on host
+// by a discovery rule and its label values, without the sender hostname
+func (ms *metricSet) lookupDiscovered(host string, key ItemKey) (*Metric, []string, bool) {
+	canonical := canonicalKey(key)
+	for _, rule := range ms.discoveries {
+		rule.discovery.mu.Lock()
+		item, ok := rule.discovery.items[host][canonical]
+		rule.discovery.mu.Unlock()
+		if ok {
+			return item.prototype, append([]string{}, item.labels...), true
+		}
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const discoveryTestDefinitions = `
+- zabbix_key: vfs.fs.size
+  metric: fs_free_bytes
+  kind: gauge
+  args: [fs, mode]
+  match_args: {mode: free}
+- zabbix_key: vfs.fs.discovery
+  kind: discovery
+  keep_lost_resources: 0s
+  prototypes:
+    - zabbix_key: 'vfs.fs.size[{#FSNAME},used]'
+      metric: fs_used_bytes
+      kind: gauge
+`
+
+func TestDiscoveredItemsNextToStaticDefinitions(t *testing.T) {
+	s := newTestServer(t, nil, discoveryTestDefinitions)
+
+	send(t, s, 1, item("h", "vfs.fs.discovery", `[{"{#FSNAME}": "/"}]`))
+	send(t, s, 3,
+		item("h", "vfs.fs.size[/,free]", "10"),
+		item("h", "vfs.fs.size[/,used]", "20"),
+		item("h", "vfs.fs.size[/boot,free]", "30"),
+	)
+	// neither the static definition nor a discovered entity accept these
+	send(t, s, 0,
+		item("h", "vfs.fs.size[/boot,used]", "40"),
+		item("other", "vfs.fs.size[/,used]", "50"),
+	)
+
+	expectSamples(t, s, map[string]float64{
+		`zi_fs_free_bytes{fs="/",zabbix_sender_hostname="h"}`:         10,
+		`zi_fs_free_bytes{fs="/boot",zabbix_sender_hostname="h"}`:     30,
+		`zi_fs_used_bytes{fsname="/",zabbix_sender_hostname="h"}`:     20,
+		`zi_fs_used_bytes{fsname="/boot",zabbix_sender_hostname="h"}`: math.NaN(),
+		`zi_fs_used_bytes{fsname="/",zabbix_sender_hostname="other"}`: math.NaN(),
+		`zi_skipped_trapper_items{reason="invalid_args"}`:             2,
+	})
+}
+
+func TestDiscoveredMacroValuesAreNotReparsed(t *testing.T) {
+	s := newTestServer(t, nil, discoveryTestDefinitions)
+
+	send(t, s, 1, item("h", "vfs.fs.discovery", `{"data": [
+		{"{#FSNAME}": "C:\\"},
+		{"{#FSNAME}": "/mnt/a,b"},
+		{"{#FSNAME}": "/mnt/\"q\" [x]"}
+	]}`))
+	send(t, s, 3,
+		item("h", `vfs.fs.size[C:\,used]`, "1"),
+		item("h", `vfs.fs.size["/mnt/a,b",used]`, "2"),
+		item("h", `vfs.fs.size["/mnt/\"q\" [x]", used]`, "3"),
+	)
+
+	expectSamples(t, s, map[string]float64{
+		`zi_fs_used_bytes{fsname="C:\\",zabbix_sender_hostname="h"}`:           1,
+		`zi_fs_used_bytes{fsname="/mnt/a,b",zabbix_sender_hostname="h"}`:       2,
+		`zi_fs_used_bytes{fsname="/mnt/\"q\" [x]",zabbix_sender_hostname="h"}`: 3,
+	})
+}
+
+// logHook records the messages logged at warning level or above
+type logHook struct {
+	messages []string
+}
+
+func (h *logHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+}
+
+func (h *logHook) Fire(e *log.Entry) error {
+	h.messages = append(h.messages, e.Message)
+	return nil
+}
+
+func TestDiscoveredEntityWithoutPrototypeMacrosIsLogged(t *testing.T) {
+	s := newTestServer(t, nil, discoveryTestDefinitions)
+
+	hook := &logHook{}
+	log.AddHook(hook)
+	log.SetLevel(log.WarnLevel)
+	defer func() {
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+		log.SetLevel(log.PanicLevel)
+	}()
+
+	value := `[{"{#FSNAME}": "/"}, {"{#FSTYPE}": "ext4"}]`
+	send(t, s, 1, item("h", "vfs.fs.discovery", value))
+	send(t, s, 1, item("h", "vfs.fs.discovery", value))
+
+	if len(hook.messages) != 1 || !strings.Contains(hook.messages[0], "map[{#FSTYPE}:ext4] of host h does not define {#FSNAME}") {
+		t.Errorf("logged %q, want a single warning for the entity without {#FSNAME}", hook.messages)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BucketsGenerator generates histogram buckets: Factor is used by
+// exponential buckets, Width by linear buckets
+type BucketsGenerator struct {
+	Start  float64 `json:"start"`
+	Factor float64 `json:"factor"`
+	Width  float64 `json:"width"`
+	Count  int     `json:"count"`
+}
+
+// histogramBuckets returns the buckets of a histogram metric, the prometheus
+// default buckets if none are configured
+func (m *Metric) histogramBuckets() ([]float64, error) {
+	var generators int
+	for _, set := range []bool{len(m.Buckets) > 0, m.ExponentialBuckets != nil, m.LinearBuckets != nil} {
+		if set {
+			generators++
+		}
+	}
+	if generators > 1 {
+		return nil, errors.New("only one of buckets, exponential_buckets and linear_buckets can be set")
+	}
+
+	switch {
+	case m.ExponentialBuckets != nil:
+		g := m.ExponentialBuckets
+		if g.Count < 1 || g.Start <= 0 || g.Factor <= 1 {
+			return nil, errors.New("exponential_buckets requires a count >= 1, a start > 0 and a factor > 1")
+		}
+		return prometheus.ExponentialBuckets(g.Start, g.Factor, g.Count), nil
+	case m.LinearBuckets != nil:
+		g := m.LinearBuckets
+		if g.Count < 1 || g.Width <= 0 {
+			return nil, errors.New("linear_buckets requires a count >= 1 and a width > 0")
+		}
+		return prometheus.LinearBuckets(g.Start, g.Width, g.Count), nil
+	case len(m.Buckets) > 0:
+		if !sort.Float64sAreSorted(m.Buckets) {
+			return nil, errors.New("buckets must be in increasing order")
+		}
+		for i := 1; i < len(m.Buckets); i++ {
+			if m.Buckets[i] == m.Buckets[i-1] {
+				return nil, fmt.Errorf("duplicate bucket %v", m.Buckets[i])
+			}
+		}
+		return m.Buckets, nil
+	}
+
+	return prometheus.DefBuckets, nil
+}
+
+// checkReservedLabel rejects metrics using a label name prometheus reserves
+// for the given kind, like le for histograms
+func (m *Metric) checkReservedLabel(reserved string) error {
+	if _, ok := m.Labels[reserved]; ok {
+		return fmt.Errorf("label %s is reserved for %s metrics", reserved, m.Kind)
+	}
+	for _, label := range m.labelNames() {
+		if label == reserved {
+			return fmt.Errorf("label %s is reserved for %s metrics", reserved, m.Kind)
+		}
+	}
+	return nil
+}
+
+// summaryObjectives returns the quantiles of a summary metric and their
+// allowed error
+func (m *Metric) summaryObjectives() (map[float64]float64, error) {
+	objectives := make(map[float64]float64)
+	for q, e := range m.Objectives {
+		quantile, err := strconv.ParseFloat(q, 64)
+		if err != nil || quantile < 0 || quantile > 1 {
+			return nil, fmt.Errorf("invalid quantile %s", q)
+		}
+		if e < 0 || e > 1 {
+			return nil, fmt.Errorf("invalid error %v for quantile %s", e, q)
+		}
+		objectives[quantile] = e
+	}
+	return objectives, nil
+}
+
+// summaryMaxAge returns the duration observations are kept for by a summary
+func (m *Metric) summaryMaxAge() (time.Duration, error) {
+	if m.MaxAge == "" {
+		return prometheus.DefMaxAge, nil
+	}
+	maxAge, err := time.ParseDuration(m.MaxAge)
+	if err != nil || maxAge <= 0 {
+		return 0, fmt.Errorf("invalid max_age %s", m.MaxAge)
+	}
+	return maxAge, nil
+}
@@ -5,8 +5,10 @@ go 1.13
 require (
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/prometheus/client_golang v1.3.0
+	github.com/prometheus/client_model v0.1.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/urfave/cli/v2 v2.1.1
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	sigs.k8s.io/yaml v1.2.0
 )
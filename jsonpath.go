@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPathSegment is a single step of a JSONPath
+type jsonPathSegment struct {
+	// name selects an object member, index an array element (negative
+	// indices count from the end)
+	name    string
+	index   int
+	isIndex bool
+	// wildcard selects all the members or elements
+	wildcard bool
+	// recursive applies the segment to every descendant (..)
+	recursive bool
+	// filter selects the elements whose member equals a value
+	filter *jsonPathFilter
+}
+
+// jsonPathFilter is a [?(@.member == value)] expression
+type jsonPathFilter struct {
+	member []string
+	op     string
+	value  interface{}
+}
+
+// jsonPathFunction aggregates the values selected by a path. It returns nil
+// if there is no result.
+type jsonPathFunction func(values []interface{}) (interface{}, error)
+
+// jsonPathFunctions are the zabbix functions that can end a path
+var jsonPathFunctions = map[string]jsonPathFunction{
+	"length": func(values []interface{}) (interface{}, error) {
+		return float64(len(values)), nil
+	},
+	"first": func(values []interface{}) (interface{}, error) {
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[0], nil
+	},
+	"sum": numericFunction(func(numbers []float64) float64 {
+		var sum float64
+		for _, n := range numbers {
+			sum += n
+		}
+		return sum
+	}),
+	"min": numericFunction(func(numbers []float64) float64 {
+		min := numbers[0]
+		for _, n := range numbers[1:] {
+			min = math.Min(min, n)
+		}
+		return min
+	}),
+	"max": numericFunction(func(numbers []float64) float64 {
+		max := numbers[0]
+		for _, n := range numbers[1:] {
+			max = math.Max(max, n)
+		}
+		return max
+	}),
+	"avg": numericFunction(func(numbers []float64) float64 {
+		var sum float64
+		for _, n := range numbers {
+			sum += n
+		}
+		return sum / float64(len(numbers))
+	}),
+}
+
+// numericFunction wraps an aggregation of numbers into a jsonPathFunction.
+// Numeric strings are accepted like in zabbix.
+func numericFunction(f func([]float64) float64) jsonPathFunction {
+	return func(values []interface{}) (interface{}, error) {
+		if len(values) == 0 {
+			return nil, nil
+		}
+		numbers := make([]float64, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case float64:
+				numbers[i] = v
+			case string:
+				n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err != nil {
+					return nil, fmt.Errorf("cannot parse %s", v)
+				}
+				numbers[i] = n
+			default:
+				return nil, fmt.Errorf("not a number: %s", jsonText(v))
+			}
+		}
+		return f(numbers), nil
+	}
+}
+
+// jsonPath is a parsed JSONPath expression. It supports a subset of the
+// syntax used by zabbix preprocessing: the root $, members (.name or
+// ['name']), array indices ([0], [-1]), wildcards (.* or [*]), recursive
+// descent (..name), equality filters ([?(@.name == 'value')]) and the
+// length(), first(), sum(), min(), max() and avg() functions at the end of
+// the path.
+type jsonPath struct {
+	expr     string
+	segments []jsonPathSegment
+	// function, if set, aggregates the selected values
+	function     jsonPathFunction
+	functionName string
+}
+
+// single reports whether the segments of the path select at most one value
+func (p *jsonPath) single() bool {
+	for _, s := range p.segments {
+		if s.wildcard || s.recursive || s.filter != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// definite reports whether the path returns at most one value
+func (p *jsonPath) definite() bool {
+	return p.function != nil || p.single()
+}
+
+func parseJSONPath(expr string) (*jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, errors.New("path must start with $")
+	}
+
+	p := &jsonPath{expr: expr}
+	rest := expr[1:]
+	if strings.HasSuffix(rest, "()") {
+		i := strings.LastIndex(rest, ".")
+		if i < 0 {
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+		name := rest[i+1 : len(rest)-2]
+		if p.function = jsonPathFunctions[name]; p.function == nil {
+			return nil, fmt.Errorf("unsupported function %s()", name)
+		}
+		p.functionName = name
+		rest = rest[:i]
+	}
+	for rest != "" {
+		var seg jsonPathSegment
+		var err error
+
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			seg.recursive = true
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				seg, rest, err = parseJSONPathBracket(rest)
+				seg.recursive = true
+			} else {
+				seg.name, rest = splitJSONPathName(rest)
+			}
+		case strings.HasPrefix(rest, "."):
+			seg.name, rest = splitJSONPathName(rest[1:])
+		case strings.HasPrefix(rest, "["):
+			seg, rest, err = parseJSONPathBracket(rest)
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if seg.name == "*" {
+			seg.name, seg.wildcard = "", true
+		}
+		if seg.name == "" && !seg.isIndex && !seg.wildcard && seg.filter == nil {
+			return nil, errors.New("empty member name")
+		}
+		p.segments = append(p.segments, seg)
+	}
+
+	return p, nil
+}
+
+// splitJSONPathName splits a dot notation member name from the rest
+func splitJSONPathName(s string) (string, string) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// parseJSONPathBracket parses a bracket notation segment
+func parseJSONPathBracket(s string) (jsonPathSegment, string, error) {
+	var seg jsonPathSegment
+
+	if strings.HasPrefix(s, "[?(") {
+		end := strings.Index(s, ")]")
+		if end < 0 {
+			return seg, "", errors.New("unterminated filter")
+		}
+		filter, err := parseJSONPathFilter(s[3:end])
+		if err != nil {
+			return seg, "", err
+		}
+		seg.filter = filter
+		return seg, s[end+2:], nil
+	}
+
+	if strings.HasPrefix(s, "['") || strings.HasPrefix(s, `["`) {
+		quote := s[1]
+		end := strings.IndexByte(s[2:], quote)
+		if end < 0 || !strings.HasPrefix(s[2+end+1:], "]") {
+			return seg, "", errors.New("unterminated member name")
+		}
+		seg.name = s[2 : 2+end]
+		return seg, s[2+end+2:], nil
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return seg, "", errors.New("unterminated bracket")
+	}
+	inner := strings.TrimSpace(s[1:end])
+	if inner == "*" {
+		seg.wildcard = true
+		return seg, s[end+1:], nil
+	}
+	index, err := strconv.Atoi(inner)
+	if err != nil {
+		return seg, "", fmt.Errorf("invalid array index %q", inner)
+	}
+	seg.index, seg.isIndex = index, true
+	return seg, s[end+1:], nil
+}
+
+// parseJSONPathFilter parses @.member == value and @.member != value
+func parseJSONPathFilter(expr string) (*jsonPathFilter, error) {
+	f := &jsonPathFilter{}
+	var left, right string
+	for _, op := range []string{"==", "!="} {
+		if i := strings.Index(expr, op); i >= 0 {
+			f.op = op
+			left, right = strings.TrimSpace(expr[:i]), strings.TrimSpace(expr[i+len(op):])
+			break
+		}
+	}
+	if f.op == "" {
+		return nil, fmt.Errorf("unsupported filter %q, only == and != are supported", expr)
+	}
+
+	if !strings.HasPrefix(left, "@.") {
+		return nil, fmt.Errorf("filter must compare a member of @: %q", expr)
+	}
+	f.member = strings.Split(left[2:], ".")
+
+	switch {
+	case len(right) >= 2 && (right[0] == '\'' || right[0] == '"') && right[len(right)-1] == right[0]:
+		f.value = right[1 : len(right)-1]
+	default:
+		if err := json.Unmarshal([]byte(right), &f.value); err != nil {
+			return nil, fmt.Errorf("invalid filter value %q", right)
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether the filter accepts an element
+func (f *jsonPathFilter) matches(v interface{}) bool {
+	for _, name := range f.member {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if v, ok = obj[name]; !ok {
+			return false
+		}
+	}
+
+	equal := fmt.Sprint(v) == fmt.Sprint(f.value)
+	if f.op == "!=" {
+		return !equal
+	}
+	return equal
+}
+
+// apply returns the values selected by a segment from v
+func (seg jsonPathSegment) apply(v interface{}) []interface{} {
+	var out []interface{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		switch {
+		case seg.wildcard:
+			for _, name := range sortedKeys(v) {
+				out = append(out, v[name])
+			}
+		case seg.filter != nil:
+			for _, name := range sortedKeys(v) {
+				if seg.filter.matches(v[name]) {
+					out = append(out, v[name])
+				}
+			}
+		case !seg.isIndex:
+			if member, ok := v[seg.name]; ok {
+				out = append(out, member)
+			}
+		}
+	case []interface{}:
+		switch {
+		case seg.wildcard:
+			out = append(out, v...)
+		case seg.filter != nil:
+			for _, e := range v {
+				if seg.filter.matches(e) {
+					out = append(out, e)
+				}
+			}
+		case seg.isIndex:
+			index := seg.index
+			if index < 0 {
+				index += len(v)
+			}
+			if index >= 0 && index < len(v) {
+				out = append(out, v[index])
+			}
+		}
+	}
+	return out
+}
+
+// descendants returns v and all the values nested in it
+func descendants(v interface{}) []interface{} {
+	out := []interface{}{v}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range sortedKeys(v) {
+			out = append(out, descendants(v[name])...)
+		}
+	case []interface{}:
+		for _, e := range v {
+			out = append(out, descendants(e)...)
+		}
+	}
+	return out
+}
+
+// eval returns every value of doc selected by the path, or the result of
+// its function
+func (p *jsonPath) eval(doc interface{}) ([]interface{}, error) {
+	matches := p.selectValues(doc)
+	if p.function == nil {
+		return matches, nil
+	}
+
+	// functions of a path selecting a single array apply to its elements
+	if p.single() {
+		if len(matches) == 0 {
+			return nil, nil
+		}
+		if array, ok := matches[0].([]interface{}); ok {
+			matches = array
+		}
+	}
+
+	result, err := p.function(matches)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %v", p.functionName, err)
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return []interface{}{result}, nil
+}
+
+// selectValues returns every value of doc selected by the segments
+func (p *jsonPath) selectValues(doc interface{}) []interface{} {
+	current := []interface{}{doc}
+	for _, seg := range p.segments {
+		var next []interface{}
+		for _, v := range current {
+			if seg.recursive {
+				for _, d := range descendants(v) {
+					next = append(next, seg.apply(d)...)
+				}
+			} else {
+				next = append(next, seg.apply(v)...)
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// extract evaluates the path on a JSON document and returns the result as
+// text, like zabbix: a single value for definite paths and a JSON array of
+// the matches otherwise
+func (p *jsonPath) extract(data string) (string, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return "", fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	matches, err := p.eval(doc)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no data matches %s", p.expr)
+	}
+	if p.definite() {
+		return jsonText(matches[0]), nil
+	}
+	return jsonText(matches), nil
+}
+
+// jsonText converts a JSON value to text: strings are returned unquoted,
+// other values are encoded
+func jsonText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return "null"
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
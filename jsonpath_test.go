@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const jsonPathTestDoc = `{
+	"store": {
+		"book": [
+			{"title": "A", "price": 8.95, "category": "reference"},
+			{"title": "B", "price": 12.99, "category": "fiction"},
+			{"title": "C", "price": 22.5, "category": "fiction"}
+		],
+		"bicycle": {"color": "red", "price": 19.95}
+	},
+	"values": [3, 1, 2, "4"],
+	"empty": [],
+	"nothing": null,
+	"hosts": {"b": {"id": 2}, "a": {"id": 1}}
+}`
+
+func TestJSONPathExtract(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		// members and indices
+		{"$.store.bicycle.color", "red"},
+		{`$['store']["bicycle"]['color']`, "red"},
+		{"$.store.book[0].title", "A"},
+		{"$.store.book[ 1 ].price", "12.99"},
+		{"$.store.book[-1].title", "C"},
+		{"$.store.book[-3].title", "A"},
+		{"$.store.book[0]", `{"category":"reference","price":8.95,"title":"A"}`},
+		{"$.nothing", "null"},
+		{"$.empty", "[]"},
+
+		// wildcards and recursive descent
+		{"$.store.book[*].title", `["A","B","C"]`},
+		{"$.store.book.*.title", `["A","B","C"]`},
+		{"$.store.bicycle.*", `["red",19.95]`},
+		{"$..id", "[1,2]"},
+		{"$..['color']", `["red"]`},
+
+		// filters
+		{"$.store.book[?(@.category == 'fiction')].title", `["B","C"]`},
+		{`$.store.book[?(@.category != "fiction")].title`, `["A"]`},
+		{"$.store.book[?(@.price == 12.99)].title", `["B"]`},
+		{"$.hosts[?(@.id == 2)]", `[{"id":2}]`},
+
+		// functions
+		{"$.values.length()", "4"},
+		{"$.values.first()", "3"},
+		{"$.values.sum()", "10"},
+		{"$.values.min()", "1"},
+		{"$.values.max()", "4"},
+		{"$.values.avg()", "2.5"},
+		{"$.values[*].max()", "4"},
+		{"$.empty.length()", "0"},
+		{"$.store.book.length()", "3"},
+		{"$.store.book[*].title.first()", "A"},
+		{"$.store.book[?(@.category == 'fiction')].length()", "2"},
+		{"$.store.book[?(@.category == 'poetry')].length()", "0"},
+		{"$.store.book[?(@.category == 'fiction')].price.min()", "12.99"},
+		{"$..price.max()", "22.5"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			p, err := parseJSONPath(tc.path)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			got, err := p.extract(jsonPathTestDoc)
+			if err != nil {
+				t.Fatalf("extract error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJSONPathExtractErrors(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		err  string
+	}{
+		{"$.missing", "no data matches"},
+		{"$.store.book[3]", "no data matches"},
+		{"$.store.book[-4]", "no data matches"},
+		{"$.store.bicycle[0]", "no data matches"},
+		{"$.store.book[?(@.category == 'poetry')].title", "no data matches"},
+		{"$.missing.length()", "no data matches"},
+		{"$.empty.first()", "no data matches"},
+		{"$.empty.sum()", "no data matches"},
+		{"$.store.book[*].title.sum()", "sum(): cannot parse A"},
+		{"$.store.book.avg()", "avg(): not a number"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			p, err := parseJSONPath(tc.path)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			_, err = p.extract(jsonPathTestDoc)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestParseJSONPathErrors(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		err  string
+	}{
+		{"store.book", "path must start with $"},
+		{"$store", "unexpected"},
+		{"$.", "empty member name"},
+		{"$.store[", "unterminated bracket"},
+		{"$.store['book", "unterminated member name"},
+		{"$.store[x]", "invalid array index"},
+		{"$.store.book[?(@.price > 10)]", "unsupported filter"},
+		{"$.store.book[?(price == 10)]", "filter must compare a member of @"},
+		{"$.store.book[?(@.price == 10]", "unterminated filter"},
+		{"$.store.book.count()", "unsupported function count()"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			_, err := parseJSONPath(tc.path)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestJSONPathDefinite(t *testing.T) {
+	for path, want := range map[string]bool{
+		"$.store.book[0].title":                  true,
+		"$.store.book[*].title":                  false,
+		"$..id":                                  false,
+		"$.store.book[?(@.price == 1)]":          false,
+		"$.store.book[*].title.first()":          true,
+		"$.store.book[?(@.price == 1)].length()": true,
+	} {
+		p, err := parseJSONPath(path)
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", path, err)
+		}
+		if got := p.definite(); got != want {
+			t.Errorf("%s: definite() = %t, want %t", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ItemKey is a zabbix item key parsed according to
+// https://www.zabbix.com/documentation/current/manual/config/items/item/key
+type ItemKey struct {
+	Name   string
+	Params []KeyParam
+}
+
+// KeyParam is a parameter of an item key. Array parameters (`[a,b]`) hold
+// their elements in Array.
+type KeyParam struct {
+	Value   string
+	Array   []string
+	IsArray bool
+}
+
+// String returns the parameter value, array elements are joined by commas
+func (p KeyParam) String() string {
+	if p.IsArray {
+		return strings.Join(p.Array, ",")
+	}
+	return p.Value
+}
+
+// Values returns the string value of every parameter
+func (k ItemKey) Values() []string {
+	values := make([]string, len(k.Params))
+	for i, p := range k.Params {
+		values[i] = p.String()
+	}
+	return values
+}
+
+// KeyParseError describes where and why an item key is invalid
+type KeyParseError struct {
+	Key string
+	Pos int
+	Msg string
+}
+
+func (e *KeyParseError) Error() string {
+	return fmt.Sprintf("invalid key %q at position %d: %s", e.Key, e.Pos, e.Msg)
+}
+
+func isKeyNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.'
+}
+
+// keyParser is a recursive descent parser for item keys
+type keyParser struct {
+	key string
+	pos int
+}
+
+func (p *keyParser) errorf(format string, args ...interface{}) error {
+	return &KeyParseError{Key: p.key, Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *keyParser) eof() bool {
+	return p.pos >= len(p.key)
+}
+
+func (p *keyParser) peek() byte {
+	return p.key[p.pos]
+}
+
+func (p *keyParser) skipSpaces() {
+	for !p.eof() && p.peek() == ' ' {
+		p.pos++
+	}
+}
+
+// ParseItemKey parses a full item key such as `vfs.fs.size["/var",free]`
+func ParseItemKey(key string) (ItemKey, error) {
+	p := &keyParser{key: key}
+	var k ItemKey
+
+	for !p.eof() && isKeyNameChar(p.peek()) {
+		p.pos++
+	}
+	k.Name = key[:p.pos]
+	if k.Name == "" {
+		return k, p.errorf("empty key name")
+	}
+
+	if p.eof() {
+		return k, nil
+	}
+	if p.peek() != '[' {
+		return k, p.errorf("invalid character %q in key name", p.peek())
+	}
+	p.pos++
+
+	params, err := p.parseParams(false)
+	if err != nil {
+		return k, err
+	}
+	k.Params = params
+
+	if !p.eof() {
+		return k, p.errorf("unexpected characters after parameters")
+	}
+
+	return k, nil
+}
+
+// parseParams parses a comma separated parameter list up to and including
+// the closing bracket. Arrays cannot be nested.
+func (p *keyParser) parseParams(inArray bool) ([]KeyParam, error) {
+	var params []KeyParam
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			return nil, p.errorf("missing closing bracket")
+		}
+
+		var param KeyParam
+		var err error
+		switch p.peek() {
+		case '"':
+			param.Value, err = p.parseQuoted()
+		case '[':
+			if inArray {
+				return nil, p.errorf("nested arrays are not allowed")
+			}
+			p.pos++
+			var elements []KeyParam
+			elements, err = p.parseParams(true)
+			if err == nil {
+				param.IsArray = true
+				for _, e := range elements {
+					param.Array = append(param.Array, e.Value)
+				}
+				p.skipSpaces()
+			}
+		default:
+			param.Value = p.parseUnquoted()
+		}
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, param)
+
+		if p.eof() {
+			return nil, p.errorf("missing closing bracket")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return params, nil
+		default:
+			return nil, p.errorf("unexpected character %q after parameter", p.peek())
+		}
+	}
+}
+
+// parseQuoted parses a quoted parameter, where `\"` escapes a quote
+func (p *keyParser) parseQuoted() (string, error) {
+	start := p.pos
+	p.pos++
+
+	var b strings.Builder
+	for !p.eof() {
+		c := p.peek()
+		switch {
+		case c == '\\' && p.pos+1 < len(p.key) && p.key[p.pos+1] == '"':
+			b.WriteByte('"')
+			p.pos += 2
+		case c == '"':
+			p.pos++
+			p.skipSpaces()
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	p.pos = start
+	return "", p.errorf("unterminated quoted parameter")
+}
+
+// parseUnquoted parses an unquoted parameter up to the next comma or bracket
+func (p *keyParser) parseUnquoted() string {
+	start := p.pos
+	for !p.eof() && p.peek() != ',' && p.peek() != ']' {
+		p.pos++
+	}
+	return p.key[start:p.pos]
+}
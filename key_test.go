@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseItemKey(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		name   string
+		params []KeyParam
+	}{
+		{"agent.ping", "agent.ping", nil},
+		{"system_cpu-load", "system_cpu-load", nil},
+		{`vfs.fs.size["/var",free]`, "vfs.fs.size", []KeyParam{{Value: "/var"}, {Value: "free"}}},
+		{`key["a,b]",c]`, "key", []KeyParam{{Value: "a,b]"}, {Value: "c"}}},
+		{`key["say \"hi\""]`, "key", []KeyParam{{Value: `say "hi"`}}},
+		{`key["a\b"]`, "key", []KeyParam{{Value: `a\b`}}},
+		{`key[ a, "b" ]`, "key", []KeyParam{{Value: "a"}, {Value: "b"}}},
+		{"key[]", "key", []KeyParam{{Value: ""}}},
+		{"key[a,,]", "key", []KeyParam{{Value: "a"}, {Value: ""}, {Value: ""}}},
+		{"net.if.in[[eth0,eth1],bytes]", "net.if.in", []KeyParam{
+			{Array: []string{"eth0", "eth1"}, IsArray: true},
+			{Value: "bytes"},
+		}},
+		{`key[a, ["b,c" , d] ]`, "key", []KeyParam{
+			{Value: "a"},
+			{Array: []string{"b,c", "d"}, IsArray: true},
+		}},
+	} {
+		t.Run(tc.key, func(t *testing.T) {
+			k, err := ParseItemKey(tc.key)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if k.Name != tc.name {
+				t.Errorf("name = %q, want %q", k.Name, tc.name)
+			}
+			if !reflect.DeepEqual(k.Params, tc.params) {
+				t.Errorf("params = %#v, want %#v", k.Params, tc.params)
+			}
+		})
+	}
+}
+
+func TestParseItemKeyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		key string
+		pos int
+		msg string
+	}{
+		{"", 0, "empty key name"},
+		{"[a]", 0, "empty key name"},
+		{"key!", 3, `invalid character '!' in key name`},
+		{"key[", 4, "missing closing bracket"},
+		{"key[a", 5, "missing closing bracket"},
+		{"key[a,[b]", 9, "missing closing bracket"},
+		{`key[a,"b`, 6, "unterminated quoted parameter"},
+		{"key[[a,[b]]]", 7, "nested arrays are not allowed"},
+		{`key["a"b]`, 7, `unexpected character 'b' after parameter`},
+		{"key[[a]b]", 7, `unexpected character 'b' after parameter`},
+		{"key[a]b", 6, "unexpected characters after parameters"},
+		{"key[a]]", 6, "unexpected characters after parameters"},
+	} {
+		t.Run(tc.key, func(t *testing.T) {
+			_, err := ParseItemKey(tc.key)
+			perr, ok := err.(*KeyParseError)
+			if !ok {
+				t.Fatalf("error = %v, want a *KeyParseError", err)
+			}
+			if perr.Key != tc.key || perr.Pos != tc.pos || perr.Msg != tc.msg {
+				t.Errorf("error = %q at %d, want %q at %d", perr.Msg, perr.Pos, tc.msg, tc.pos)
+			}
+		})
+	}
+}
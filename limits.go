@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Series limits, also used as the reason of the rejected items
+const (
+	limitGlobal = "global"
+	limitMetric = "metric"
+	limitHost   = "host"
+)
+
+// defaultSeriesReportSize is the number of metrics and hosts listed by the
+// series endpoint
+const defaultSeriesReportSize = 10
+
+// seriesLimitError signals a value rejected because its new series would
+// exceed a limit
+type seriesLimitError struct {
+	limit string
+	max   int
+}
+
+func (e *seriesLimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d series reached", e.limit, e.max)
+}
+
+// seriesLimits counts the series of all the metrics to enforce the global and
+// per host limits. 0 disables a limit.
+type seriesLimits struct {
+	mu         sync.Mutex
+	maxSeries  int
+	maxPerHost int
+	total      int
+	hosts      map[string]int
+}
+
+func newSeriesLimits(maxSeries, maxPerHost int) *seriesLimits {
+	return &seriesLimits{
+		maxSeries:  maxSeries,
+		maxPerHost: maxPerHost,
+		hosts:      make(map[string]int),
+	}
+}
+
+// acquire accounts for a new series of host
+func (l *seriesLimits) acquire(host string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSeries > 0 && l.total >= l.maxSeries {
+		return &seriesLimitError{limitGlobal, l.maxSeries}
+	}
+	if l.maxPerHost > 0 && l.hosts[host] >= l.maxPerHost {
+		return &seriesLimitError{limitHost, l.maxPerHost}
+	}
+	l.total++
+	l.hosts[host]++
+	return nil
+}
+
+// release accounts for a removed series of host
+func (l *seriesLimits) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.hosts[host]--; l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+}
+
+// reserve accounts for a new series for labels, whose first label is the
+// sender hostname, unless it would exceed max or the shared limits
+func (t *seriesTracker) reserve(labels []string, max int) error {
+	if max > 0 && len(t.series) >= max {
+		return &seriesLimitError{limitMetric, max}
+	}
+	if t.limits == nil {
+		return nil
+	}
+	return t.limits.acquire(labels[0])
+}
+
+// unreserve accounts for a removed series
+func (t *seriesTracker) unreserve(labels []string) {
+	if t.limits != nil {
+		t.limits.release(labels[0])
+	}
+}
+
+// detach releases the series of a metric that is no longer used from the
+// shared limits
+func (m *Metric) detach() {
+	if m.series == nil {
+		return
+	}
+
+	m.series.mu.Lock()
+	defer m.series.mu.Unlock()
+
+	for _, sr := range m.series.series {
+		m.series.unreserve(sr.labels)
+	}
+	m.series.limits = nil
+}
+
+// initLimits sets the maximum number of series of a metric
+func (s *ZServer) initLimits(metric *Metric) error {
+	if metric.MaxSeries < 0 {
+		return fmt.Errorf("invalid max_series %d for metric %s", metric.MaxSeries, metric.Metric)
+	}
+	metric.maxSeries = metric.MaxSeries
+	if metric.maxSeries == 0 {
+		metric.maxSeries = s.Config.MetricsMaxSeriesPerMetric
+	}
+	return nil
+}
+
+// seriesCount is the number of series of a metric or host
+type seriesCount struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+}
+
+// seriesReport lists the metrics and hosts with the most series
+type seriesReport struct {
+	Total   int            `json:"total"`
+	Limits  map[string]int `json:"limits"`
+	Metrics []seriesCount  `json:"metrics"`
+	Hosts   []seriesCount  `json:"hosts"`
+}
+
+// heaviest returns the n largest counts
+func heaviest(counts []seriesCount, n int) []seriesCount {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Series != counts[j].Series {
+			return counts[i].Series > counts[j].Series
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// seriesReport reports the n metrics and hosts with the most series
+func (s *ZServer) seriesReport(n int) seriesReport {
+	metrics := []seriesCount{}
+	if current := s.currentMetrics(); current != nil {
+		for _, master := range current.metrics {
+			for _, m := range master.definitions() {
+				if m.collector == nil {
+					continue
+				}
+				m.series.mu.Lock()
+				count := len(m.series.series)
+				m.series.mu.Unlock()
+				metrics = append(metrics, seriesCount{Name: s.metricName(m), Series: count})
+			}
+		}
+	}
+
+	s.limits.mu.Lock()
+	defer s.limits.mu.Unlock()
+
+	hosts := make([]seriesCount, 0, len(s.limits.hosts))
+	for host, count := range s.limits.hosts {
+		hosts = append(hosts, seriesCount{Name: host, Series: count})
+	}
+
+	return seriesReport{
+		Total: s.limits.total,
+		Limits: map[string]int{
+			limitGlobal: s.limits.maxSeries,
+			limitMetric: s.Config.MetricsMaxSeriesPerMetric,
+			limitHost:   s.limits.maxPerHost,
+		},
+		Metrics: heaviest(metrics, n),
+		Hosts:   heaviest(hosts, n),
+	}
+}
+
+// seriesHandler serves the series report as JSON. The number of metrics and
+// hosts listed is set by the limit query parameter.
+func (s *ZServer) seriesHandler(w http.ResponseWriter, r *http.Request) {
+	n := defaultSeriesReportSize
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if n, err = strconv.Atoi(limit); err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", limit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.seriesReport(n))
+}
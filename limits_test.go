@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSeriesLimits(t *testing.T) {
+	s := newTestServer(t, &ZServerConfig{
+		MetricsMaxSeries:          5,
+		MetricsMaxSeriesPerMetric: 3,
+		MetricsMaxSeriesPerHost:   2,
+	}, `
+- zabbix_key: temp
+  kind: gauge
+  args: [id]
+- zabbix_key: load
+  kind: gauge
+  args: [cpu]
+  max_series: 1
+- zabbix_key: fan
+  kind: gauge`)
+
+	send(t, s, 1, item("a", "load[0]", 1))
+	// per metric limit, max_series overriding --metrics.max-series-per-metric
+	send(t, s, 0, item("b", "load[1]", 1))
+	// existing series are still updated
+	send(t, s, 1, item("a", "load[0]", 2))
+
+	send(t, s, 1, item("a", "temp[0]", 1))
+	// per host limit
+	send(t, s, 0, item("a", "temp[1]", 1))
+	send(t, s, 2, item("b", "temp[0]", 1), item("b", "temp[1]", 1))
+	// per metric limit
+	send(t, s, 0, item("c", "temp[0]", 1))
+
+	send(t, s, 1, item("c", "fan", 1))
+	// global limit, 5 series being exposed
+	send(t, s, 0, item("d", "fan", 1))
+
+	if got := skipped(t, s, skipSeriesLimit); got != 4 {
+		t.Errorf("%v items skipped for series limits, want 4", got)
+	}
+	expectSamples(t, s, map[string]float64{
+		`zi_series_limit_rejected_items_total{limit="metric"}`: 2,
+		`zi_series_limit_rejected_items_total{limit="host"}`:   1,
+		`zi_series_limit_rejected_items_total{limit="global"}`: 1,
+	})
+
+	// removed series free their slots
+	definition(t, s, "temp[0]").deleteSeries([]string{"b", "1"})
+	send(t, s, 1, item("d", "temp[0]", 1))
+
+	report := s.seriesReport(1)
+	want := seriesReport{
+		Total:   5,
+		Limits:  map[string]int{limitGlobal: 5, limitMetric: 3, limitHost: 2},
+		Metrics: []seriesCount{{Name: "zi_temp", Series: 3}},
+		Hosts:   []seriesCount{{Name: "a", Series: 2}},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/-/series?limit=2", nil))
+	var served seriesReport
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served.Metrics) != 2 || len(served.Hosts) != 2 {
+		t.Errorf("served %d metrics and %d hosts, want 2 of each", len(served.Metrics), len(served.Hosts))
+	}
+
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/-/series?limit=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d for an invalid limit, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ListenerConfig defines a port the server accepts zabbix requests on
+type ListenerConfig struct {
+	ListenAddress string
+	ListenPort    int64
+	IPWhitelist   []*net.IP
+	CIDRWhitelist []*net.IPNet
+	// TLS enables certificate based encryption on the listener
+	TLS *TLSConfig
+}
+
+// Address returns the host:port the listener binds to
+func (c *ListenerConfig) Address() string {
+	return fmt.Sprintf("%s:%d", c.ListenAddress, c.ListenPort)
+}
+
+func (c *ListenerConfig) checkIPAllowed(ip string) bool {
+	for _, i := range c.IPWhitelist {
+		if i.String() == ip {
+			return true
+		}
+	}
+	for _, n := range c.CIDRWhitelist {
+		if n.Contains(net.ParseIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// listener is a running ListenerConfig
+type listener struct {
+	config *ListenerConfig
+	tls    *tlsReloader
+	net.Listener
+}
+
+// listen binds the listener address and sets up its TLS configuration
+func (s *ZServer) listen(c *ListenerConfig) (*listener, error) {
+	l := &listener{config: c}
+	if c.TLS != nil {
+		tls, err := newTLSReloader(c.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("could not configure TLS for %s: %v", c.Address(), err)
+		}
+		l.tls = tls
+	}
+
+	nl, err := net.Listen("tcp", c.Address())
+	if err != nil {
+		return nil, fmt.Errorf("could not start listening: %v", err)
+	}
+	l.Listener = nl
+	if l.tls != nil {
+		go l.tls.watch(tlsReloadInterval)
+	}
+
+	return l, nil
+}
+
+// serve accepts connections on l until it fails
+func (s *ZServer) serve(l *listener) error {
+	defer l.Close()
+
+	log.Infof("Listening for zabbix sender requests on %s", l.config.Address())
+	for {
+		// Listen for an incoming connection.
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("error accepting connection on %s: %v", l.config.Address(), err)
+		}
+		// Handle connections in a new goroutine.
+		go s.handleRequest(l, conn)
+	}
+}
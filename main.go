@@ -1,9 +1,10 @@
 package main
 
 import (
-	"net"
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -19,11 +20,48 @@ var (
 	metricsNamespace     string
 	logLevel             string
 	logFormat            string
+
+	configFile      string
+	configListeners []map[string]string
+
+	serverMaxBodySize    uint64
+	serverReadTimeout    time.Duration
+	serverWriteTimeout   time.Duration
+	serverTLSCertFile    string
+	serverTLSKeyFile     string
+	serverTLSCAFile      string
+	serverTLSRequireCert bool
+	serverTLSAccept      string
+	serverTLSSubject     string
+	serverTLSIssuer      string
+
+	metricsPath           string
+	metricsSelfPath       string
+	metricsHonorTS        bool
+	metricsMaxItemAge     time.Duration
+	metricsReloadInterval time.Duration
+	metricsReloadEndpoint bool
+	metricsSeriesTTL      time.Duration
+	metricsLastSeen       bool
+	metricsMaxSeries      int
+	metricsMaxPerMetric   int
+	metricsMaxPerHost     int
+	metricsUnknownKeys    int
+	metricsUnknownExposed int
+
+	pollerFile       string
+	proxyItemMapFile string
 )
 
 func main() {
 	app := &cli.App{
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "config.file",
+				Usage:       "YAML config file. Flags and environment variables take precedence over its settings",
+				EnvVars:     []string{"ZI_CONFIG_FILE"},
+				Destination: &configFile,
+			},
 			&cli.StringFlag{
 				Name:        "server.listen-address",
 				Value:       "0.0.0.0",
@@ -45,6 +83,70 @@ func main() {
 				EnvVars:     []string{"ZI_SERVER_IP_WHITELIST"},
 				DefaultText: "0.0.0.0/0",
 			},
+			&cli.Uint64Flag{
+				Name:        "server.max-body-size",
+				Value:       defaultMaxBodySize,
+				Usage:       "maximum size in bytes of a (decompressed) request body",
+				EnvVars:     []string{"ZI_SERVER_MAX_BODY_SIZE"},
+				Destination: &serverMaxBodySize,
+			},
+			&cli.DurationFlag{
+				Name:        "server.read-timeout",
+				Value:       10 * time.Second,
+				Usage:       "maximum duration for reading a request",
+				EnvVars:     []string{"ZI_SERVER_READ_TIMEOUT"},
+				Destination: &serverReadTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "server.write-timeout",
+				Value:       10 * time.Second,
+				Usage:       "maximum duration for writing a response",
+				EnvVars:     []string{"ZI_SERVER_WRITE_TIMEOUT"},
+				Destination: &serverWriteTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "server.tls-cert-file",
+				Usage:       "server certificate file, enables TLS on the server port",
+				EnvVars:     []string{"ZI_SERVER_TLS_CERT_FILE"},
+				Destination: &serverTLSCertFile,
+			},
+			&cli.StringFlag{
+				Name:        "server.tls-key-file",
+				Usage:       "server private key file",
+				EnvVars:     []string{"ZI_SERVER_TLS_KEY_FILE"},
+				Destination: &serverTLSKeyFile,
+			},
+			&cli.StringFlag{
+				Name:        "server.tls-ca-file",
+				Usage:       "CA bundle used to verify client certificates",
+				EnvVars:     []string{"ZI_SERVER_TLS_CA_FILE"},
+				Destination: &serverTLSCAFile,
+			},
+			&cli.BoolFlag{
+				Name:        "server.tls-require-client-cert",
+				Usage:       "reject TLS clients that do not present a valid certificate",
+				EnvVars:     []string{"ZI_SERVER_TLS_REQUIRE_CLIENT_CERT"},
+				Destination: &serverTLSRequireCert,
+			},
+			&cli.StringFlag{
+				Name:        "server.tls-accept",
+				Value:       "cert",
+				Usage:       "accepted incoming connections when TLS is enabled. Comma separated list of: [unencrypted, cert]",
+				EnvVars:     []string{"ZI_SERVER_TLS_ACCEPT"},
+				Destination: &serverTLSAccept,
+			},
+			&cli.StringFlag{
+				Name:        "server.tls-subject",
+				Usage:       "required client certificate subject",
+				EnvVars:     []string{"ZI_SERVER_TLS_SUBJECT"},
+				Destination: &serverTLSSubject,
+			},
+			&cli.StringFlag{
+				Name:        "server.tls-issuer",
+				Usage:       "required client certificate issuer",
+				EnvVars:     []string{"ZI_SERVER_TLS_ISSUER"},
+				Destination: &serverTLSIssuer,
+			},
 			&cli.StringFlag{
 				Name:        "metrics.listen-address",
 				Value:       "0.0.0.0",
@@ -59,10 +161,23 @@ func main() {
 				EnvVars:     []string{"ZI_METRICS_LISTEN_PORT"},
 				Destination: &metricsListenPort,
 			},
+			&cli.StringFlag{
+				Name:        "metrics.path",
+				Value:       "/metrics",
+				Usage:       "path to expose the converted metrics under",
+				EnvVars:     []string{"ZI_METRICS_PATH"},
+				Destination: &metricsPath,
+			},
+			&cli.StringFlag{
+				Name:        "metrics.self-path",
+				Usage:       "path to expose the self-metrics under (exposed along the converted metrics if empty)",
+				EnvVars:     []string{"ZI_METRICS_SELF_PATH"},
+				Destination: &metricsSelfPath,
+			},
 			&cli.StringFlag{
 				Name:        "metrics.file",
 				Value:       "metrics.json",
-				Usage:       "metrics definition file",
+				Usage:       "metrics definition file (JSON or YAML), directory of definition files or glob",
 				EnvVars:     []string{"ZI_METRICS_FILE"},
 				Destination: &metricsFile,
 			},
@@ -73,6 +188,85 @@ func main() {
 				EnvVars:     []string{"ZI_METRICS_NAMESPACE"},
 				Destination: &metricsNamespace,
 			},
+			&cli.BoolFlag{
+				Name:        "metrics.honor-timestamps",
+				Usage:       "expose samples with the clock sent by the zabbix client as timestamp",
+				EnvVars:     []string{"ZI_METRICS_HONOR_TIMESTAMPS"},
+				Destination: &metricsHonorTS,
+			},
+			&cli.DurationFlag{
+				Name:        "metrics.max-item-age",
+				Usage:       "skip items whose clock is older than this (0 disables the check)",
+				EnvVars:     []string{"ZI_METRICS_MAX_ITEM_AGE"},
+				Destination: &metricsMaxItemAge,
+			},
+			&cli.DurationFlag{
+				Name:        "metrics.reload-interval",
+				Usage:       "interval to check the metrics file for changes at (0 disables watching)",
+				EnvVars:     []string{"ZI_METRICS_RELOAD_INTERVAL"},
+				Destination: &metricsReloadInterval,
+			},
+			&cli.BoolFlag{
+				Name:        "metrics.enable-reload-endpoint",
+				Usage:       "reload the metrics file on POST requests to /-/reload",
+				EnvVars:     []string{"ZI_METRICS_ENABLE_RELOAD_ENDPOINT"},
+				Destination: &metricsReloadEndpoint,
+			},
+			&cli.DurationFlag{
+				Name:        "metrics.series-ttl",
+				Usage:       "remove series that did not receive values for this long, unless set per metric (0 keeps them forever)",
+				EnvVars:     []string{"ZI_METRICS_SERIES_TTL"},
+				Destination: &metricsSeriesTTL,
+			},
+			&cli.BoolFlag{
+				Name:        "metrics.last-seen",
+				Usage:       "expose the time every series last received a value as <metric>_last_seen_timestamp_seconds, unless set per metric",
+				EnvVars:     []string{"ZI_METRICS_LAST_SEEN"},
+				Destination: &metricsLastSeen,
+			},
+			&cli.IntFlag{
+				Name:        "metrics.max-series",
+				Usage:       "maximum number of series of all the metrics (0 disables the limit)",
+				EnvVars:     []string{"ZI_METRICS_MAX_SERIES"},
+				Destination: &metricsMaxSeries,
+			},
+			&cli.IntFlag{
+				Name:        "metrics.max-series-per-metric",
+				Usage:       "maximum number of series of a metric, unless set per metric (0 disables the limit)",
+				EnvVars:     []string{"ZI_METRICS_MAX_SERIES_PER_METRIC"},
+				Destination: &metricsMaxPerMetric,
+			},
+			&cli.IntFlag{
+				Name:        "metrics.max-series-per-host",
+				Usage:       "maximum number of series of a zabbix_sender_hostname (0 disables the limit)",
+				EnvVars:     []string{"ZI_METRICS_MAX_SERIES_PER_HOST"},
+				Destination: &metricsMaxPerHost,
+			},
+			&cli.IntFlag{
+				Name:        "metrics.unknown-keys-cache-size",
+				Value:       1000,
+				Usage:       "number of unknown keys remembered (0 disables the cache)",
+				EnvVars:     []string{"ZI_METRICS_UNKNOWN_KEYS_CACHE_SIZE"},
+				Destination: &metricsUnknownKeys,
+			},
+			&cli.IntFlag{
+				Name:        "metrics.unknown-keys-exposed",
+				Usage:       "number of most recently seen unknown keys exposed as unknown_trapper_items_total (0 disables the metric)",
+				EnvVars:     []string{"ZI_METRICS_UNKNOWN_KEYS_EXPOSED"},
+				Destination: &metricsUnknownExposed,
+			},
+			&cli.StringFlag{
+				Name:        "poller.file",
+				Usage:       "zabbix agents to poll with passive checks (disabled if empty)",
+				EnvVars:     []string{"ZI_POLLER_FILE"},
+				Destination: &pollerFile,
+			},
+			&cli.StringFlag{
+				Name:        "proxy.item-map-file",
+				Usage:       "JSON file mapping the itemids sent by zabbix proxies to their host and key (disabled if empty)",
+				EnvVars:     []string{"ZI_PROXY_ITEM_MAP_FILE"},
+				Destination: &proxyItemMapFile,
+			},
 			&cli.StringFlag{
 				Name:        "log.level",
 				Value:       "info",
@@ -89,12 +283,56 @@ func main() {
 			},
 		},
 		Before: func(c *cli.Context) error {
+			if configFile != "" {
+				listeners, err := loadConfigFile(c, configFile)
+				if err != nil {
+					return err
+				}
+				configListeners = listeners
+			}
+
 			// StringSliceFlag doesn't support Destination https://github.com/urfave/cli/issues/603
 			if len(c.StringSlice("server.ip-whitelist")) > 0 {
 				serverIPWhitelist = c.StringSlice("server.ip-whitelist")
 			}
 			return nil
 		},
+		Commands: []*cli.Command{
+			{
+				Name:      "validate",
+				Usage:     "validate metrics files without starting the server",
+				ArgsUsage: "[metrics files, directories or globs (defaults to --metrics.file)]",
+				Action: func(c *cli.Context) error {
+					files := c.Args().Slice()
+					if len(files) == 0 {
+						files = []string{metricsFile}
+					}
+
+					s := NewZServer(&ZServerConfig{
+						MetricsNamespace:          metricsNamespace,
+						MetricsSeriesTTL:          metricsSeriesTTL,
+						MetricsLastSeen:           metricsLastSeen,
+						MetricsMaxSeriesPerMetric: metricsMaxPerMetric,
+					})
+					var failed int
+					for _, file := range files {
+						problems := s.validateMetricsFiles(file)
+						for _, p := range problems {
+							fmt.Println(p)
+						}
+						if len(problems) > 0 {
+							failed++
+						}
+					}
+
+					if failed > 0 {
+						return cli.Exit(fmt.Sprintf("%d of %d metrics paths are invalid", failed, len(files)), 1)
+					}
+					fmt.Printf("all %d metrics paths are valid\n", len(files))
+					return nil
+				},
+			},
+		},
 		Action: func(c *cli.Context) error {
 			switch strings.ToLower(logLevel) {
 			case "debug":
@@ -120,37 +358,65 @@ func main() {
 				log.Fatalf("invalid log format requested: %s", logFormat)
 			}
 
-			var cidrWhitelist []*net.IPNet
-			var ipWhitelist []*net.IP
-			for _, iparg := range serverIPWhitelist {
-				ips := strings.Split(iparg, ",")
-				for _, ip := range ips {
-					if strings.Contains(ip, "/") {
-						_, ipnet, err := net.ParseCIDR(ip)
-						if err != nil {
-							log.Fatalf("could not parse CIDR: %v", err)
-						}
-						cidrWhitelist = append(cidrWhitelist, ipnet)
-					} else {
-						if parsedIP := net.ParseIP(ip); parsedIP != nil {
-							ipWhitelist = append(ipWhitelist, &parsedIP)
-						} else {
-							log.Fatalf("could not parse IP: %s", ip)
-						}
-					}
+			// listeners default to the server.* settings
+			defaults := map[string]string{
+				"listen-address":          serverListenAddress,
+				"listen-port":             fmt.Sprint(serverListenPort),
+				"ip-whitelist":            strings.Join(serverIPWhitelist, ","),
+				"tls-cert-file":           serverTLSCertFile,
+				"tls-key-file":            serverTLSKeyFile,
+				"tls-ca-file":             serverTLSCAFile,
+				"tls-require-client-cert": fmt.Sprint(serverTLSRequireCert),
+				"tls-accept":              serverTLSAccept,
+				"tls-subject":             serverTLSSubject,
+				"tls-issuer":              serverTLSIssuer,
+			}
+			if len(configListeners) == 0 {
+				configListeners = []map[string]string{{}}
+			}
 
+			var listeners []*ListenerConfig
+			for i, overrides := range configListeners {
+				settings := make(map[string]string)
+				for name, value := range defaults {
+					settings[name] = value
+				}
+				for name, value := range overrides {
+					settings[name] = value
 				}
+
+				l, err := newListenerConfig(settings)
+				if err != nil {
+					log.Fatalf("invalid listener %d: %v", i, err)
+				}
+				listeners = append(listeners, l)
 			}
 
 			s := NewZServer(&ZServerConfig{
-				ServerListenAddress:  serverListenAddress,
-				ServerListenPort:     serverListenPort,
-				ServerIPWhitelist:    ipWhitelist,
-				ServerCIDRWhitelist:  cidrWhitelist,
-				MetricsListenAddress: metricsListenAddress,
-				MetricsListenPort:    metricsListenPort,
-				MetricsFile:          metricsFile,
-				MetricsNamespace:     metricsNamespace,
+				Listeners:          listeners,
+				ServerMaxBodySize:  serverMaxBodySize,
+				ServerReadTimeout:  serverReadTimeout,
+				ServerWriteTimeout: serverWriteTimeout,
+
+				MetricsListenAddress:        metricsListenAddress,
+				MetricsListenPort:           metricsListenPort,
+				MetricsPath:                 metricsPath,
+				MetricsSelfPath:             metricsSelfPath,
+				MetricsFile:                 metricsFile,
+				MetricsNamespace:            metricsNamespace,
+				MetricsHonorTimestamps:      metricsHonorTS,
+				MetricsMaxItemAge:           metricsMaxItemAge,
+				MetricsReloadInterval:       metricsReloadInterval,
+				MetricsReloadEndpoint:       metricsReloadEndpoint,
+				MetricsSeriesTTL:            metricsSeriesTTL,
+				MetricsLastSeen:             metricsLastSeen,
+				MetricsMaxSeries:            metricsMaxSeries,
+				MetricsMaxSeriesPerMetric:   metricsMaxPerMetric,
+				MetricsMaxSeriesPerHost:     metricsMaxPerHost,
+				MetricsUnknownKeysCacheSize: metricsUnknownKeys,
+				MetricsUnknownKeysExposed:   metricsUnknownExposed,
+				PollerFile:                  pollerFile,
+				ProxyItemMapFile:            proxyItemMapFile,
 			})
 			return s.Run()
 		},
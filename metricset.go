@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricSet holds the metric definitions indexed for zabbix key lookups
+type metricSet struct {
+	// metrics holds all definitions in definition order
+	metrics []*Metric
+	// keys holds the overloads of every exact key, most specific first
+	keys     map[string][]*Metric
+	patterns []*Metric
+	// discoveries holds the discovery rules
+	discoveries []*Metric
+	// registry holds the collectors of all definitions
+	registry *prometheus.Registry
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{keys: make(map[string][]*Metric)}
+}
+
+func (ms *metricSet) add(m *Metric) {
+	ms.metrics = append(ms.metrics, m)
+	if m.discovery != nil {
+		ms.discoveries = append(ms.discoveries, m)
+	}
+	if m.keyRegexp != nil {
+		ms.patterns = append(ms.patterns, m)
+		return
+	}
+
+	overloads := append(ms.keys[m.ZabbixKey], m)
+	sort.SliceStable(overloads, func(i, j int) bool {
+		return len(overloads[i].MatchArgs) > len(overloads[j].MatchArgs)
+	})
+	ms.keys[m.ZabbixKey] = overloads
+}
+
+// lookup returns the metric for a key and its label values, without the
+// sender hostname. Exact keys take precedence over patterns, which are tried
+// in definition order. Overloads of the same key are tried from the most to
+// the least specific. known reports whether any definition matched the key
+// name, even if none accepted its parameters.
+func (ms *metricSet) lookup(key ItemKey) (metric *Metric, labels []string, known bool) {
+	for _, m := range ms.keys[key.Name] {
+		known = true
+		if labels, ok := m.match(key); ok {
+			return m, labels, true
+		}
+	}
+	for _, m := range ms.patterns {
+		if _, ok := m.matchName(key.Name); !ok {
+			continue
+		}
+		known = true
+		if labels, ok := m.match(key); ok {
+			return m, labels, true
+		}
+	}
+	return nil, nil, known
+}
+
+// initArgs validates the arg selectors and defaults of the metric
+func (m *Metric) initArgs() error {
+	for name := range m.MatchArgs {
+		if m.argIndex(name) == -1 {
+			return fmt.Errorf("match_args references unknown arg %s", name)
+		}
+	}
+
+	m.requiredArgs = len(m.Args)
+	for name := range m.Defaults {
+		i := m.argIndex(name)
+		if i == -1 {
+			return fmt.Errorf("defaults references unknown arg %s", name)
+		}
+		if i < m.requiredArgs {
+			m.requiredArgs = i
+		}
+	}
+	for _, name := range m.Args[m.requiredArgs:] {
+		if _, ok := m.Defaults[name]; !ok {
+			return fmt.Errorf("arg %s follows an optional arg and needs a default", name)
+		}
+	}
+
+	return nil
+}
+
+func (m *Metric) argIndex(name string) int {
+	for i, arg := range m.Args {
+		if arg == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// match checks a key against the metric name, arity and arg selectors, and
+// returns its label values without the sender hostname
+func (m *Metric) match(key ItemKey) ([]string, bool) {
+	captures, ok := m.matchName(key.Name)
+	if !ok {
+		return nil, false
+	}
+
+	params := key.Values()
+	if len(params) > len(m.Args) || len(params) < m.requiredArgs {
+		return nil, false
+	}
+
+	var labels []string
+	for i, name := range m.Args {
+		var value string
+		if i < len(params) {
+			value = params[i]
+		}
+		if value == "" {
+			if def, ok := m.Defaults[name]; ok {
+				value = def
+			}
+		}
+
+		if literal, ok := m.MatchArgs[name]; ok {
+			if value != literal {
+				return nil, false
+			}
+			continue
+		}
+		labels = append(labels, value)
+	}
+
+	return append(labels, captures...), true
+}
+
+// globToRegexp converts a key glob into a regular expression: `*` matches
+// any characters, `?` a single character and `{label}` one or more
+// characters other than `.`, captured into label
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '{':
+			end := strings.IndexByte(glob[i:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("missing closing brace in %s", glob)
+			}
+			b.WriteString("(?P<" + glob[i+1:i+end] + ">[^.]+)")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
+
+// initKeyPattern compiles the glob or regex the metric matches keys with
+func (m *Metric) initKeyPattern() error {
+	var expr string
+	var err error
+
+	switch {
+	case m.ZabbixKeyGlob != "" && m.ZabbixKeyRegex != "",
+		m.ZabbixKey != "" && (m.ZabbixKeyGlob != "" || m.ZabbixKeyRegex != ""):
+		return errors.New("only one of zabbix_key, zabbix_key_glob and zabbix_key_regex can be defined")
+	case m.ZabbixKeyGlob != "":
+		if expr, err = globToRegexp(m.ZabbixKeyGlob); err != nil {
+			return err
+		}
+	case m.ZabbixKeyRegex != "":
+		expr = m.ZabbixKeyRegex
+	default:
+		return nil
+	}
+
+	if m.Metric == "" {
+		return errors.New("metric is required for key patterns")
+	}
+
+	m.keyRegexp, err = regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid key pattern: %v", err)
+	}
+
+	for _, name := range m.keyRegexp.SubexpNames() {
+		if name != "" {
+			m.captures = append(m.captures, name)
+		}
+	}
+
+	return nil
+}
+
+// matchName matches a key name against the metric pattern and returns the
+// values of the named capture groups
+func (m *Metric) matchName(name string) ([]string, bool) {
+	if m.keyRegexp == nil {
+		return nil, name == m.ZabbixKey
+	}
+
+	match := m.keyRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return nil, false
+	}
+
+	var captures []string
+	for i, n := range m.keyRegexp.SubexpNames() {
+		if n != "" {
+			captures = append(captures, match[i])
+		}
+	}
+	return captures, true
+}
+
+// labelNames returns the label names of the metric: the sender hostname,
+// the key parameters not fixed by match_args and the key pattern captures
+func (m *Metric) labelNames() []string {
+	labels := m.seriesLabelNames()
+	if m.ValueLabel != "" {
+		labels = append(labels, m.ValueLabel)
+	}
+	return labels
+}
+
+// seriesLabelNames returns the label names identifying a series, which
+// exclude the value label of info and stateset metrics
+func (m *Metric) seriesLabelNames() []string {
+	labels := []string{"zabbix_sender_hostname"}
+	for _, name := range m.Args {
+		if _, ok := m.MatchArgs[name]; !ok {
+			labels = append(labels, name)
+		}
+	}
+	labels = append(labels, m.captures...)
+	labels = append(labels, m.macroLabels...)
+	labels = append(labels, m.elementLabels...)
+	return labels
+}
+
+// keyDescription describes the keys matched by the metric for logging
+func (m *Metric) keyDescription() string {
+	switch {
+	case m.ZabbixKeyGlob != "":
+		return "zabbix key glob " + m.ZabbixKeyGlob
+	case m.ZabbixKeyRegex != "":
+		return "zabbix key regex " + m.ZabbixKeyRegex
+	}
+	return "zabbix key " + m.ZabbixKey
+}
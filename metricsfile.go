@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// MetricDefaults are defaults shared by all the definitions of a file
+type MetricDefaults struct {
+	// Namespace replaces the server namespace of the metric names
+	Namespace string `json:"namespace"`
+	// Labels are constant labels added to every metric
+	Labels map[string]string `json:"labels"`
+}
+
+// apply fills in the fields the metric does not define
+func (d MetricDefaults) apply(m *Metric) {
+	if m.Namespace == "" {
+		m.Namespace = d.Namespace
+	}
+	if len(d.Labels) == 0 {
+		return
+	}
+
+	labels := make(map[string]string)
+	for name, value := range d.Labels {
+		labels[name] = value
+	}
+	for name, value := range m.Labels {
+		labels[name] = value
+	}
+	m.Labels = labels
+}
+
+// definitionsElement is a metric definition and its offset in the file
+type definitionsElement struct {
+	raw    json.RawMessage
+	offset int64
+}
+
+// definitionsFile is a parsed metrics file. YAML files are converted to JSON.
+type definitionsFile struct {
+	path     string
+	data     []byte
+	yaml     bool
+	defaults MetricDefaults
+	// rawDefaults is the compacted defaults, part of the definitions
+	// fingerprints
+	rawDefaults string
+	elements    []definitionsElement
+}
+
+// definitionsFileError is a problem in a metrics file at a given offset
+type definitionsFileError struct {
+	offset int64
+	err    error
+}
+
+func (e *definitionsFileError) Error() string {
+	return e.err.Error()
+}
+
+// isYAMLFile reports whether a file is YAML based on its extension
+func isYAMLFile(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// metricsFilePaths returns the files matched by path: the file itself, the
+// JSON and YAML files of a directory or the files matching a glob, sorted by
+// name
+func metricsFilePaths(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		files, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %s: %v", path, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no metrics files match %s", path)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || (ext != ".json" && !isYAMLFile(e.Name())) {
+			continue
+		}
+		files = append(files, filepath.Join(path, e.Name()))
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no metrics files found in %s", path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readMetricsFile reads and parses a metrics file. The file contains either
+// an array of definitions or an object with the "defaults" for the file and
+// the array of definitions under "metrics".
+func readMetricsFile(path string) (*definitionsFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &definitionsFile{path: path, data: data}
+	if isYAMLFile(path) {
+		f.yaml = true
+		if f.data, err = yaml.YAMLToJSON(data); err != nil {
+			return nil, fmt.Errorf("could not parse yaml: %v", err)
+		}
+	}
+
+	if err := f.parse(); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// parse walks the JSON data recording the offset of every definition
+func (f *definitionsFile) parse() error {
+	dec := json.NewDecoder(bytes.NewReader(f.data))
+	wrap := func(err error) error {
+		if serr, ok := err.(*json.SyntaxError); ok {
+			return &definitionsFileError{offset: serr.Offset, err: err}
+		}
+		return &definitionsFileError{offset: dec.InputOffset(), err: err}
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return wrap(err)
+	}
+
+	switch tok {
+	case json.Delim('['):
+		if err := f.parseElements(dec); err != nil {
+			return wrap(err)
+		}
+	case json.Delim('{'):
+		for dec.More() {
+			offset := dec.InputOffset()
+			key, err := dec.Token()
+			if err != nil {
+				return wrap(err)
+			}
+			switch key {
+			case "defaults":
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					return wrap(err)
+				}
+				strict := json.NewDecoder(bytes.NewReader(raw))
+				strict.DisallowUnknownFields()
+				if err := strict.Decode(&f.defaults); err != nil {
+					return &definitionsFileError{offset: offset, err: fmt.Errorf("invalid defaults: %v", err)}
+				}
+				var compacted bytes.Buffer
+				json.Compact(&compacted, raw)
+				f.rawDefaults = compacted.String()
+			case "metrics":
+				if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+					return &definitionsFileError{offset: offset, err: errors.New("metrics must be an array")}
+				}
+				if err := f.parseElements(dec); err != nil {
+					return wrap(err)
+				}
+			default:
+				return &definitionsFileError{offset: offset, err: fmt.Errorf("unknown field %q", key)}
+			}
+		}
+	default:
+		return &definitionsFileError{err: errors.New("metrics file must contain an array or an object")}
+	}
+
+	return nil
+}
+
+// parseElements records the definitions of an array up to its closing bracket
+func (f *definitionsFile) parseElements(dec *json.Decoder) error {
+	for dec.More() {
+		offset := dec.InputOffset()
+		for offset < int64(len(f.data)) && strings.IndexByte(" \t\r\n,", f.data[offset]) != -1 {
+			offset++
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		f.elements = append(f.elements, definitionsElement{raw: raw, offset: offset})
+	}
+
+	_, err := dec.Token()
+	return err
+}
+
+// fingerprint identifies a definition including the file defaults
+func (f *definitionsFile) fingerprint(e definitionsElement) string {
+	var compacted bytes.Buffer
+	json.Compact(&compacted, e.raw)
+	return compacted.String() + f.rawDefaults
+}
+
+// readMetricsFiles reads all the metrics files matched by path
+func readMetricsFiles(path string) ([]*definitionsFile, error) {
+	paths, err := metricsFilePaths(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*definitionsFile
+	for _, p := range paths {
+		f, err := readMetricsFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFilePaths(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"b.yml", "a.json", "c.YAML", ".hidden.json", "notes.txt"} {
+		writeFile(t, dir, name, "[]")
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := os.Mkdir(empty, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want []string
+		err  string
+	}{
+		{"a.json", []string{"a.json"}, ""},
+		{"", []string{"a.json", "b.yml", "c.YAML"}, ""},
+		{"*.y*", []string{"b.yml"}, ""},
+		{"[a-b].*", []string{"a.json", "b.yml"}, ""},
+		{"*.toml", nil, "no metrics files match"},
+		{"empty", nil, "no metrics files found in"},
+		{"missing.json", nil, "no such file or directory"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			paths, err := metricsFilePaths(filepath.Join(dir, tc.path))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range paths {
+				paths[i] = filepath.Base(paths[i])
+			}
+			if strings.Join(paths, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("paths = %v, want %v", paths, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadMetricsDirectory(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "a.json", `[{"zabbix_key": "temp", "kind": "gauge", "labels": {"team": "a"}}]`)
+	writeFile(t, dir, "b.yaml", `
+defaults:
+  namespace: storage
+  labels: {team: b, site: x}
+metrics:
+- zabbix_key: disk
+  kind: gauge
+  labels: {team: c}
+- zabbix_key: load
+  kind: gauge
+  namespace: node
+`)
+
+	s := newTestServer(t, &ZServerConfig{MetricsFile: dir}, "")
+	send(t, s, 3, item("h", "temp", 1), item("h", "disk", 2), item("h", "load", 3))
+	expectSamples(t, s, map[string]float64{
+		`zi_temp{team="a",zabbix_sender_hostname="h"}`:               1,
+		`storage_disk{site="x",team="c",zabbix_sender_hostname="h"}`: 2,
+		`node_load{site="x",team="b",zabbix_sender_hostname="h"}`:    3,
+	})
+
+	// definitions clashing across files are rejected
+	writeFile(t, dir, "c.yml", `
+- zabbix_key: temp
+  metric: other
+  kind: gauge
+`)
+	err := s.reloadMetrics()
+	if err == nil || !strings.Contains(err.Error(), "duplicate definition for zabbix key temp, already defined by "+filepath.Join(dir, "a.json")) {
+		t.Errorf("error = %v, want a duplicate definition", err)
+	}
+}
+
+func TestReadMetricsFileErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"scalar.json", `1`, "metrics file must contain an array or an object"},
+		{"field.json", `{"metric": []}`, `unknown field "metric"`},
+		{"array.json", `{"metrics": {}}`, "metrics must be an array"},
+		{"defaults.json", `{"defaults": {"kind": "gauge"}, "metrics": []}`, `invalid defaults: json: unknown field "kind"`},
+		{"syntax.json", `[{"zabbix_key": "a"},]`, "invalid character ','"},
+		{"syntax.yaml", "- a: [", "could not parse yaml"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readMetricsFile(writeFile(t, dir, tc.name, tc.data))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
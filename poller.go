@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAgentPort    = "10050"
+	defaultPollTimeout  = 3 * time.Second
+	agentNotSupportedID = "ZBX_NOTSUPPORTED"
+)
+
+// PollerTarget defines a zabbix agent polled with passive checks
+type PollerTarget struct {
+	// Address is the host:port of the agent. The port defaults to 10050.
+	Address string `json:"address"`
+	// Host is the zabbix_sender_hostname of the collected items. Defaults
+	// to the host part of Address.
+	Host string `json:"host"`
+	// Keys are the full item keys requested from the agent
+	Keys []string `json:"keys"`
+	// Interval between polls. If empty the agent is polled on every scrape
+	// of the metrics endpoint.
+	Interval string `json:"interval"`
+	// Timeout of every passive check. Defaults to 3s.
+	Timeout string `json:"timeout"`
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// init validates the target and fills in the defaults
+func (t *PollerTarget) init() error {
+	if t.Address == "" {
+		return errors.New("found empty address")
+	}
+	if len(t.Keys) == 0 {
+		return fmt.Errorf("no keys defined for target %s", t.Address)
+	}
+
+	if _, _, err := net.SplitHostPort(t.Address); err != nil {
+		t.Address = net.JoinHostPort(t.Address, defaultAgentPort)
+	}
+	if t.Host == "" {
+		t.Host, _, _ = net.SplitHostPort(t.Address)
+	}
+
+	var err error
+	if t.Interval != "" {
+		if t.interval, err = time.ParseDuration(t.Interval); err != nil || t.interval <= 0 {
+			return fmt.Errorf("invalid interval for target %s: %s", t.Address, t.Interval)
+		}
+	}
+
+	t.timeout = defaultPollTimeout
+	if t.Timeout != "" {
+		if t.timeout, err = time.ParseDuration(t.Timeout); err != nil || t.timeout <= 0 {
+			return fmt.Errorf("invalid timeout for target %s: %s", t.Address, t.Timeout)
+		}
+	}
+
+	return nil
+}
+
+// poller polls zabbix agents using the passive checks protocol and feeds the
+// results into the ZServer metrics
+type poller struct {
+	server  *ZServer
+	targets []*PollerTarget
+}
+
+func newPoller(s *ZServer, file string) (*poller, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %v", err)
+	}
+
+	var targets []*PollerTarget
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("could not parse json: %v", err)
+	}
+
+	for _, t := range targets {
+		if err := t.init(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &poller{server: s, targets: targets}, nil
+}
+
+// start polls the targets with an interval in the background
+func (p *poller) start() {
+	for _, t := range p.targets {
+		if t.interval == 0 {
+			log.Infof("Polling agent %s on scrape", t.Address)
+			continue
+		}
+
+		log.Infof("Polling agent %s every %s", t.Address, t.interval)
+		go func(t *PollerTarget) {
+			p.poll(t)
+			for range time.Tick(t.interval) {
+				p.poll(t)
+			}
+		}(t)
+	}
+}
+
+// scrapeHandler polls the scrape-driven targets before calling next
+func (p *poller) scrapeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wg sync.WaitGroup
+		for _, t := range p.targets {
+			if t.interval != 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(t *PollerTarget) {
+				defer wg.Done()
+				p.poll(t)
+			}(t)
+		}
+		wg.Wait()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// poll requests all keys from a target and applies the results
+func (p *poller) poll(t *PollerTarget) {
+	start := time.Now()
+
+	up := 1.0
+	var items []TrapperItem
+	for _, key := range t.Keys {
+		value, err := p.get(t, key)
+		if err != nil {
+			var notSupported *agentNotSupportedError
+			if !errors.As(err, &notSupported) {
+				up = 0
+			}
+			log.WithFields(log.Fields{
+				"target": t.Address,
+			}).Warnf("could not get %s: %v", key, err)
+			p.server.selfMetrics.trapperItemsSkipped.WithLabelValues(skipPollFailed).Inc()
+			continue
+		}
+
+		items = append(items, TrapperItem{
+			Host:    t.Host,
+			FullKey: key,
+			Value:   value,
+			Clock:   time.Now().Unix(),
+		})
+	}
+
+	if len(items) > 0 {
+		p.server.processTrapperItems(t.Address, items)
+	}
+
+	p.server.selfMetrics.pollerTargetUp.WithLabelValues(t.Address).Set(up)
+	p.server.selfMetrics.pollerPollDuration.WithLabelValues(t.Address).Set(time.Since(start).Seconds())
+}
+
+// agentNotSupportedError is returned for items the agent cannot collect
+type agentNotSupportedError struct {
+	reason string
+}
+
+func (e *agentNotSupportedError) Error() string {
+	return fmt.Sprintf("item not supported: %s", e.reason)
+}
+
+// get requests a single key from an agent (the zabbix_get protocol)
+func (p *poller) get(t *PollerTarget, key string) (string, error) {
+	conn, err := net.DialTimeout("tcp", t.Address, t.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(t.timeout))
+
+	request, err := zabbixPacket(zabbixFlagProtocol, []byte(key))
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return "", fmt.Errorf("could not write request: %v", err)
+	}
+
+	_, body, err := readZabbixPacket(conn, p.server.Config.ServerMaxBodySize)
+	if err != nil {
+		return "", err
+	}
+
+	value := string(body)
+	if strings.HasPrefix(value, agentNotSupportedID) {
+		reason := strings.TrimLeft(strings.TrimPrefix(value, agentNotSupportedID), "\x00")
+		return "", &agentNotSupportedError{reason: reason}
+	}
+
+	return value, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Preprocessing step types
+const (
+	stepMultiplier                    = "multiplier"
+	stepSimpleChange                  = "simple_change"
+	stepChangePerSecond               = "change_per_second"
+	stepBoolToDecimal                 = "bool_to_decimal"
+	stepHexToDecimal                  = "hex_to_decimal"
+	stepOctalToDecimal                = "octal_to_decimal"
+	stepTrim                          = "trim"
+	stepLTrim                         = "ltrim"
+	stepRTrim                         = "rtrim"
+	stepRegex                         = "regex"
+	stepJSONPath                      = "jsonpath"
+	stepInRange                       = "in_range"
+	stepDiscardUnchangedWithHeartbeat = "discard_unchanged_with_heartbeat"
+)
+
+// Preprocessing error handlers
+const (
+	errorHandlerFail     = "fail"
+	errorHandlerDiscard  = "discard"
+	errorHandlerSetValue = "set_value"
+)
+
+// stepParamCounts is the number of params of every step type
+var stepParamCounts = map[string]int{
+	stepMultiplier:                    1,
+	stepSimpleChange:                  0,
+	stepChangePerSecond:               0,
+	stepBoolToDecimal:                 0,
+	stepHexToDecimal:                  0,
+	stepOctalToDecimal:                0,
+	stepTrim:                          1,
+	stepLTrim:                         1,
+	stepRTrim:                         1,
+	stepRegex:                         2,
+	stepJSONPath:                      1,
+	stepInRange:                       2,
+	stepDiscardUnchangedWithHeartbeat: 1,
+}
+
+var (
+	boolTrue  = []string{"true", "t", "yes", "y", "on", "up", "running", "enabled", "available", "ok", "master"}
+	boolFalse = []string{"false", "f", "no", "n", "off", "down", "unused", "disabled", "unavailable", "err", "slave"}
+
+	// regexBackref matches the \N references of regex step outputs
+	regexBackref = regexp.MustCompile(`\\([0-9])`)
+)
+
+// stepParams are the params of a step. Numbers and booleans are accepted
+// and converted to strings.
+type stepParams []string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (p *stepParams) UnmarshalJSON(data []byte) error {
+	var raw []interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = make(stepParams, len(raw))
+	for i, v := range raw {
+		switch v := v.(type) {
+		case string:
+			(*p)[i] = v
+		case float64:
+			(*p)[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			(*p)[i] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("invalid param %v", v)
+		}
+	}
+	return nil
+}
+
+// PreprocessingStep transforms the values of a metric before they are
+// applied, like zabbix item preprocessing
+type PreprocessingStep struct {
+	Type   string     `json:"type"`
+	Params stepParams `json:"params"`
+	// ErrorHandler is what happens when the step fails: fail the item (the
+	// default), discard the value or set_value to ErrorHandlerParams
+	ErrorHandler string `json:"error_handler"`
+	// ErrorHandlerParams is the value set by set_value or the error message
+	// of fail
+	ErrorHandlerParams string `json:"error_handler_params"`
+
+	multiplier float64
+	min, max   *float64
+	heartbeat  time.Duration
+	regex      *regexp.Regexp
+	output     string
+	jsonPath   *jsonPath
+}
+
+// stepState is the state kept by a step for a single series
+type stepState struct {
+	seen  bool
+	last  string
+	clock time.Time
+	// kept is the time of the last value kept by discard unchanged steps
+	kept time.Time
+}
+
+// discardedError signals a value dropped by preprocessing
+type discardedError struct {
+	reason string
+}
+
+func (e *discardedError) Error() string {
+	return "value discarded: " + e.reason
+}
+
+// init validates the step and compiles its params
+func (st *PreprocessingStep) init() error {
+	count, ok := stepParamCounts[st.Type]
+	if !ok {
+		return fmt.Errorf("unknown preprocessing step %q", st.Type)
+	}
+	if len(st.Params) != count {
+		return fmt.Errorf("step %s requires %d params, got %d", st.Type, count, len(st.Params))
+	}
+
+	switch st.ErrorHandler {
+	case "":
+		st.ErrorHandler = errorHandlerFail
+	case errorHandlerFail, errorHandlerDiscard, errorHandlerSetValue:
+	default:
+		return fmt.Errorf("invalid error handler %q for step %s", st.ErrorHandler, st.Type)
+	}
+
+	var err error
+	switch st.Type {
+	case stepMultiplier:
+		if st.multiplier, err = strconv.ParseFloat(st.Params[0], 64); err != nil {
+			return fmt.Errorf("invalid multiplier %q", st.Params[0])
+		}
+	case stepRegex:
+		if st.regex, err = regexp.Compile(st.Params[0]); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+		st.output = regexBackref.ReplaceAllString(strings.Replace(st.Params[1], "$", "$$", -1), "${$1}")
+	case stepJSONPath:
+		if st.jsonPath, err = parseJSONPath(st.Params[0]); err != nil {
+			return fmt.Errorf("invalid jsonpath %q: %v", st.Params[0], err)
+		}
+	case stepInRange:
+		for i, bound := range []**float64{&st.min, &st.max} {
+			if st.Params[i] == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(st.Params[i], 64)
+			if err != nil {
+				return fmt.Errorf("invalid range bound %q", st.Params[i])
+			}
+			*bound = &v
+		}
+		if st.min == nil && st.max == nil {
+			return errors.New("in_range requires a min or a max")
+		}
+	case stepDiscardUnchangedWithHeartbeat:
+		seconds, err := strconv.ParseFloat(st.Params[0], 64)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("invalid heartbeat %q", st.Params[0])
+		}
+		st.heartbeat = time.Duration(seconds * float64(time.Second))
+	}
+
+	return nil
+}
+
+// apply runs the step on value
+func (st *PreprocessingStep) apply(value string, ts time.Time, state *stepState) (string, error) {
+	switch st.Type {
+	case stepMultiplier:
+		v, err := parseNumber(value)
+		if err != nil {
+			return "", err
+		}
+		return formatNumber(v * st.multiplier), nil
+	case stepSimpleChange, stepChangePerSecond:
+		v, err := parseNumber(value)
+		if err != nil {
+			return "", err
+		}
+		last, seen, clock := state.last, state.seen, state.clock
+		state.seen, state.last, state.clock = true, value, ts
+		if !seen {
+			return "", &discardedError{"first value of " + st.Type}
+		}
+
+		prev, _ := parseNumber(last)
+		if st.Type == stepSimpleChange {
+			return formatNumber(v - prev), nil
+		}
+		if v < prev {
+			return "", &discardedError{"counter reset"}
+		}
+		seconds := ts.Sub(clock).Seconds()
+		if seconds <= 0 {
+			return "", &discardedError{"no time elapsed since the previous value"}
+		}
+		return formatNumber((v - prev) / seconds), nil
+	case stepBoolToDecimal:
+		lower := strings.ToLower(strings.TrimSpace(value))
+		for _, t := range boolTrue {
+			if lower == t {
+				return "1", nil
+			}
+		}
+		for _, f := range boolFalse {
+			if lower == f {
+				return "0", nil
+			}
+		}
+		if v, err := parseNumber(lower); err == nil {
+			if v != 0 {
+				return "1", nil
+			}
+			return "0", nil
+		}
+		return "", fmt.Errorf("cannot convert %q to boolean", value)
+	case stepHexToDecimal, stepOctalToDecimal:
+		base := 16
+		digits := strings.TrimSpace(value)
+		if st.Type == stepOctalToDecimal {
+			base = 8
+		} else {
+			digits = strings.TrimPrefix(strings.TrimPrefix(digits, "0x"), "0X")
+		}
+		v, err := strconv.ParseUint(digits, base, 64)
+		if err != nil {
+			return "", fmt.Errorf("cannot convert %q from base %d", value, base)
+		}
+		return strconv.FormatUint(v, 10), nil
+	case stepTrim:
+		return strings.Trim(value, st.Params[0]), nil
+	case stepLTrim:
+		return strings.TrimLeft(value, st.Params[0]), nil
+	case stepRTrim:
+		return strings.TrimRight(value, st.Params[0]), nil
+	case stepRegex:
+		match := st.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return "", fmt.Errorf("%q does not match %s", value, st.regex)
+		}
+		return string(st.regex.ExpandString(nil, st.output, value, match)), nil
+	case stepJSONPath:
+		return st.jsonPath.extract(value)
+	case stepInRange:
+		v, err := parseNumber(value)
+		if err != nil {
+			return "", err
+		}
+		if (st.min != nil && v < *st.min) || (st.max != nil && v > *st.max) {
+			return "", fmt.Errorf("value %s is out of range", value)
+		}
+		return value, nil
+	case stepDiscardUnchangedWithHeartbeat:
+		unchanged := state.seen && state.last == value && ts.Sub(state.kept) < st.heartbeat
+		state.seen, state.last = true, value
+		if unchanged {
+			return "", &discardedError{"unchanged value"}
+		}
+		state.kept = ts
+		return value, nil
+	}
+
+	return value, nil
+}
+
+// preprocess runs the preprocessing steps of the metric on a value of the
+// series sr. Callers must hold the series lock.
+func (m *Metric) preprocess(sr *series, value string, ts time.Time) (string, error) {
+	for i, st := range m.Preprocessing {
+		result, err := st.apply(value, ts, sr.steps[i])
+		if err == nil {
+			value = result
+			continue
+		}
+		if _, ok := err.(*discardedError); ok {
+			return "", err
+		}
+
+		switch st.ErrorHandler {
+		case errorHandlerDiscard:
+			return "", &discardedError{fmt.Sprintf("step %s failed: %v", st.Type, err)}
+		case errorHandlerSetValue:
+			return st.ErrorHandlerParams, nil
+		}
+		if st.ErrorHandlerParams != "" {
+			return "", errors.New(st.ErrorHandlerParams)
+		}
+		return "", fmt.Errorf("preprocessing step %s failed: %v", st.Type, err)
+	}
+
+	return value, nil
+}
+
+func parseNumber(value string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s", value)
+	}
+	return v, nil
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
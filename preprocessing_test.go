@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// step returns an initialized preprocessing step
+func step(t *testing.T, typ string, params ...string) *PreprocessingStep {
+	t.Helper()
+	st := &PreprocessingStep{Type: typ, Params: params}
+	if err := st.init(); err != nil {
+		t.Fatalf("%s: init error: %v", typ, err)
+	}
+	return st
+}
+
+func TestPreprocessingStepParams(t *testing.T) {
+	var st PreprocessingStep
+	if err := json.Unmarshal([]byte(`{"type":"regex","params":["a", 1.5, true]}`), &st); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(st.Params, ","); got != "a,1.5,true" {
+		t.Errorf("params = %s, want a,1.5,true", got)
+	}
+
+	if err := json.Unmarshal([]byte(`{"type":"regex","params":[null]}`), &st); err == nil {
+		t.Error("null param accepted")
+	}
+}
+
+func TestPreprocessingStepInitErrors(t *testing.T) {
+	for _, tc := range []struct {
+		step PreprocessingStep
+		err  string
+	}{
+		{PreprocessingStep{Type: "round"}, `unknown preprocessing step "round"`},
+		{PreprocessingStep{Type: stepMultiplier}, "step multiplier requires 1 params, got 0"},
+		{PreprocessingStep{Type: stepTrim, Params: []string{" ", " "}}, "step trim requires 1 params, got 2"},
+		{PreprocessingStep{Type: stepMultiplier, Params: []string{"x"}}, `invalid multiplier "x"`},
+		{PreprocessingStep{Type: stepRegex, Params: []string{"(", ""}}, "invalid regex"},
+		{PreprocessingStep{Type: stepJSONPath, Params: []string{"a.b"}}, `invalid jsonpath "a.b"`},
+		{PreprocessingStep{Type: stepInRange, Params: []string{"", ""}}, "in_range requires a min or a max"},
+		{PreprocessingStep{Type: stepInRange, Params: []string{"low", ""}}, `invalid range bound "low"`},
+		{PreprocessingStep{Type: stepDiscardUnchangedWithHeartbeat, Params: []string{"0"}}, `invalid heartbeat "0"`},
+		{PreprocessingStep{Type: stepTrim, Params: []string{" "}, ErrorHandler: "ignore"}, `invalid error handler "ignore" for step trim`},
+	} {
+		t.Run(tc.err, func(t *testing.T) {
+			err := tc.step.init()
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestPreprocessingStepApply(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		typ    string
+		params []string
+		value  string
+		want   string
+		err    string
+	}{
+		{"multiplier", stepMultiplier, []string{"0.5"}, "3", "1.5", ""},
+		{"multiplier of text", stepMultiplier, []string{"2"}, "x", "", "cannot parse x"},
+		{"bool true", stepBoolToDecimal, nil, " Up ", "1", ""},
+		{"bool false", stepBoolToDecimal, nil, "disabled", "0", ""},
+		{"bool number", stepBoolToDecimal, nil, "2", "1", ""},
+		{"bool zero", stepBoolToDecimal, nil, "0", "0", ""},
+		{"bool unknown", stepBoolToDecimal, nil, "maybe", "", `cannot convert "maybe" to boolean`},
+		{"hex", stepHexToDecimal, nil, "0xff", "255", ""},
+		{"hex without prefix", stepHexToDecimal, nil, "1A", "26", ""},
+		{"hex invalid", stepHexToDecimal, nil, "0xg", "", `cannot convert "0xg" from base 16`},
+		{"octal", stepOctalToDecimal, nil, "17", "15", ""},
+		{"octal invalid", stepOctalToDecimal, nil, "8", "", `cannot convert "8" from base 8`},
+		{"trim", stepTrim, []string{" ."}, ". a .", "a", ""},
+		{"ltrim", stepLTrim, []string{"0"}, "0010", "10", ""},
+		{"rtrim", stepRTrim, []string{"%"}, "42%%", "42", ""},
+		{"regex", stepRegex, []string{`(\d+) of (\d+)`, `\2-\1$`}, "used 3 of 10", "10-3$", ""},
+		{"regex whole match", stepRegex, []string{`\d+`, `<\0>`}, "a12b", "<12>", ""},
+		{"regex no match", stepRegex, []string{`\d+`, `\0`}, "none", "", `"none" does not match \d+`},
+		{"jsonpath", stepJSONPath, []string{"$.a[1]"}, `{"a":[1,2]}`, "2", ""},
+		{"jsonpath no match", stepJSONPath, []string{"$.b"}, `{"a":1}`, "", "no data matches"},
+		{"in range", stepInRange, []string{"0", "100"}, "100", "100", ""},
+		{"below range", stepInRange, []string{"0", ""}, "-1", "", "value -1 is out of range"},
+		{"above range", stepInRange, []string{"", "100"}, "101", "", "value 101 is out of range"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := step(t, tc.typ, tc.params...).apply(tc.value, time.Now(), &stepState{})
+			switch {
+			case tc.err != "":
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error = %v, want %q", err, tc.err)
+				}
+			case err != nil:
+				t.Errorf("error: %v", err)
+			case got != tc.want:
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPreprocessingStatefulSteps(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	// discarded values are expected with an empty result
+	type value struct {
+		value   string
+		seconds int
+		want    string
+	}
+	for _, tc := range []struct {
+		name   string
+		typ    string
+		params []string
+		values []value
+	}{
+		{"simple change", stepSimpleChange, nil, []value{
+			{"10", 0, ""},
+			{"15", 10, "5"},
+			{"12", 20, "-3"},
+		}},
+		{"change per second", stepChangePerSecond, nil, []value{
+			{"100", 0, ""},
+			{"150", 10, "5"},
+			{"150", 10, ""},
+			{"160", 15, "2"},
+			{"10", 20, ""},
+			{"30", 30, "2"},
+		}},
+		{"discard unchanged with heartbeat", stepDiscardUnchangedWithHeartbeat, []string{"60"}, []value{
+			{"a", 0, "a"},
+			{"a", 30, ""},
+			{"b", 40, "b"},
+			{"b", 99, ""},
+			{"b", 100, "b"},
+			{"a", 101, "a"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := step(t, tc.typ, tc.params...)
+			state := &stepState{}
+			for i, v := range tc.values {
+				got, err := st.apply(v.value, start.Add(time.Duration(v.seconds)*time.Second), state)
+				if v.want == "" {
+					if _, ok := err.(*discardedError); !ok {
+						t.Errorf("value %d (%s): got %q, %v, want it discarded", i, v.value, got, err)
+					}
+				} else if err != nil || got != v.want {
+					t.Errorf("value %d (%s): got %q, %v, want %q", i, v.value, got, err, v.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPreprocessingErrorHandlers(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		handler   string
+		params    string
+		want      string
+		err       string
+		discarded bool
+	}{
+		{"fail", "", "", "", "preprocessing step multiplier failed: cannot parse x", false},
+		{"custom error", errorHandlerFail, "not a number", "", "not a number", false},
+		{"discard", errorHandlerDiscard, "", "", "value discarded: step multiplier failed", true},
+		{"set value", errorHandlerSetValue, "-1", "-1", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &Metric{Preprocessing: []*PreprocessingStep{
+				{Type: stepMultiplier, Params: []string{"2"}, ErrorHandler: tc.handler, ErrorHandlerParams: tc.params},
+				// set_value skips the remaining steps
+				{Type: stepMultiplier, Params: []string{"10"}},
+			}}
+			for _, st := range m.Preprocessing {
+				if err := st.init(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sr := newSeriesTracker(nil).add(nil, len(m.Preprocessing))
+			got, err := m.preprocess(sr, "x", time.Now())
+			if _, ok := err.(*discardedError); ok != tc.discarded {
+				t.Errorf("discarded = %t, want %t", ok, tc.discarded)
+			}
+			switch {
+			case tc.err != "":
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error = %v, want %q", err, tc.err)
+				}
+			case err != nil:
+				t.Errorf("error: %v", err)
+			case got != tc.want:
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// steps run in order on the result of the previous step
+	m := &Metric{Preprocessing: []*PreprocessingStep{
+		step(t, stepTrim, " "),
+		step(t, stepMultiplier, "2"),
+		step(t, stepMultiplier, "10"),
+	}}
+	sr := newSeriesTracker(nil).add(nil, len(m.Preprocessing))
+	if got, err := m.preprocess(sr, " 3 ", time.Now()); err != nil || got != "60" {
+		t.Errorf("got %q, %v, want 60", got, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Zabbix proxy request types
+const (
+	requestProxyData      = "proxy data"
+	requestProxyHeartbeat = "proxy heartbeat"
+)
+
+// ProxyRequest is a "proxy data" request sent by an active zabbix proxy
+type ProxyRequest struct {
+	Host                  string                       `json:"host"`
+	HostAvailability      []ProxyHostAvailability      `json:"host availability"`
+	InterfaceAvailability []ProxyInterfaceAvailability `json:"interface availability"`
+	HistoryData           []ProxyHistoryItem           `json:"history data"`
+	DiscoveryData         []ProxyDiscoveryItem         `json:"discovery data"`
+}
+
+// ProxyHostAvailability is the per-host availability sent by zabbix proxies
+// older than 5.4
+type ProxyHostAvailability struct {
+	HostID        uint64 `json:"hostid"`
+	Available     *int   `json:"available"`
+	SNMPAvailable *int   `json:"snmp_available"`
+	IPMIAvailable *int   `json:"ipmi_available"`
+	JMXAvailable  *int   `json:"jmx_available"`
+}
+
+// ProxyInterfaceAvailability is the per-interface availability sent by zabbix
+// proxies 5.4 and newer
+type ProxyInterfaceAvailability struct {
+	InterfaceID uint64 `json:"interfaceid"`
+	Available   int    `json:"available"`
+}
+
+// ProxyHistoryItem is a collected value forwarded by a zabbix proxy. Values
+// without host and key are resolved by their itemid with the proxy item map.
+type ProxyHistoryItem struct {
+	TrapperItem
+	ItemID uint64 `json:"itemid"`
+}
+
+// ProxyDiscoveryItem is a network discovery result forwarded by a zabbix proxy
+type ProxyDiscoveryItem struct {
+	DRule  uint64 `json:"drule"`
+	DCheck uint64 `json:"dcheck"`
+	IP     string `json:"ip"`
+	Port   int    `json:"port"`
+	Status int    `json:"status"`
+}
+
+// ProxyItem maps the itemid of the values sent by zabbix proxies 4.0 and
+// newer, which carry no host and key, to the item of the zabbix server
+// configuration
+type ProxyItem struct {
+	ItemID uint64 `json:"itemid"`
+	Host   string `json:"host"`
+	Key    string `json:"key"`
+}
+
+// loadProxyItems reads the proxy item map file
+func loadProxyItems(file string) (map[uint64]ProxyItem, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %v", err)
+	}
+
+	var list []ProxyItem
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("could not parse json: %v", err)
+	}
+
+	items := make(map[uint64]ProxyItem, len(list))
+	for i, item := range list {
+		if item.ItemID == 0 {
+			return nil, fmt.Errorf("item %d: missing itemid", i)
+		}
+		if item.Host == "" || item.Key == "" {
+			return nil, fmt.Errorf("item %d: host and key are required", item.ItemID)
+		}
+		if _, ok := items[item.ItemID]; ok {
+			return nil, fmt.Errorf("item %d: duplicate itemid", item.ItemID)
+		}
+		items[item.ItemID] = item
+	}
+	if len(items) == 0 {
+		return nil, errors.New("no items defined")
+	}
+	return items, nil
+}
+
+// resolveProxyItem fills in the host and key of a history value from its itemid and
+// reports whether it can be mapped to a Metric
+func (s *ZServer) resolveProxyItem(h *ProxyHistoryItem) bool {
+	if h.Host != "" && h.FullKey != "" {
+		return true
+	}
+	item, ok := s.proxyItems[h.ItemID]
+	if !ok {
+		return false
+	}
+	h.Host = item.Host
+	h.FullKey = item.Key
+	return true
+}
+
+// handleProxyData processes a "proxy data" request and returns the number of
+// processed and received history values
+func (s *ZServer) handleProxyData(ip string, body []byte) (int, int, error) {
+	var request ProxyRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return 0, 0, fmt.Errorf("could not unmarshal proxy data: %v", err)
+	}
+
+	s.selfMetrics.proxyLastSeen.WithLabelValues(request.Host).SetToCurrentTime()
+
+	for _, h := range request.HostAvailability {
+		hostID := strconv.FormatUint(h.HostID, 10)
+		for iface, available := range map[string]*int{
+			"agent": h.Available,
+			"snmp":  h.SNMPAvailable,
+			"ipmi":  h.IPMIAvailable,
+			"jmx":   h.JMXAvailable,
+		} {
+			if available != nil {
+				s.selfMetrics.proxyHostAvailability.WithLabelValues(request.Host, hostID, iface).Set(float64(*available))
+			}
+		}
+	}
+
+	for _, i := range request.InterfaceAvailability {
+		interfaceID := strconv.FormatUint(i.InterfaceID, 10)
+		s.selfMetrics.proxyInterfaceAvailability.WithLabelValues(request.Host, interfaceID).Set(float64(i.Available))
+	}
+
+	for _, d := range request.DiscoveryData {
+		up := 0.0
+		if d.Status == 0 {
+			up = 1
+		}
+		s.selfMetrics.proxyDiscoveredServiceUp.WithLabelValues(
+			request.Host,
+			strconv.FormatUint(d.DRule, 10),
+			strconv.FormatUint(d.DCheck, 10),
+			d.IP,
+			strconv.Itoa(d.Port),
+		).Set(up)
+	}
+
+	var items []TrapperItem
+	var unresolved int
+	for _, h := range request.HistoryData {
+		if !s.resolveProxyItem(&h) {
+			unresolved++
+			continue
+		}
+		items = append(items, h.TrapperItem)
+	}
+	if unresolved > 0 {
+		log.WithFields(log.Fields{
+			"remote_ip": ip,
+		}).Warnf("Skipping %d history values from proxy %s without host and key or known itemid", unresolved, request.Host)
+		s.selfMetrics.trapperItemsSkipped.WithLabelValues(skipUnresolved).Add(float64(unresolved))
+	}
+
+	processed, total := s.processTrapperItems(ip, items)
+
+	return processed, total + unresolved, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadMetrics loads the metrics file and atomically replaces the current
+// definitions. Unchanged definitions keep their series.
+func (s *ZServer) reloadMetrics() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	metrics, err := s.loadMetricsFiles(s.Config.MetricsFile, s.currentMetrics())
+	if err == nil {
+		err = s.swapMetrics(metrics)
+	}
+	if err != nil {
+		s.selfMetrics.configReloads.WithLabelValues("failure").Inc()
+		s.selfMetrics.configLastReloadSuccessful.Set(0)
+		return err
+	}
+
+	s.selfMetrics.configReloads.WithLabelValues("success").Inc()
+	s.selfMetrics.configLastReloadSuccessful.Set(1)
+	s.selfMetrics.configLastReloadSuccess.SetToCurrentTime()
+	log.Infof("Loaded %d metric definitions from %s", len(metrics.metrics), s.Config.MetricsFile)
+
+	return nil
+}
+
+// swapMetrics registers the collectors of metrics in a new registry and
+// makes them current. Nothing changes if a collector cannot be registered.
+// Building a new registry is required to change the help or labels of an
+// existing metric name, the prometheus registry does not allow it.
+func (s *ZServer) swapMetrics(metrics *metricSet) error {
+	registry := prometheus.NewRegistry()
+	for _, master := range metrics.metrics {
+		for _, m := range master.definitions() {
+			if m.collector == nil {
+				continue
+			}
+			if err := registry.Register(m.collector); err != nil {
+				return fmt.Errorf("could not register metric %s: %v", m.Metric, err)
+			}
+		}
+	}
+
+	previous := s.currentMetrics()
+	metrics.registry = registry
+	s.metrics.Store(metrics)
+
+	// the series of the definitions that were not reused no longer count
+	// towards the limits
+	if previous != nil {
+		kept := make(map[*Metric]bool)
+		for _, master := range metrics.metrics {
+			for _, m := range master.definitions() {
+				kept[m] = true
+			}
+		}
+		for _, master := range previous.metrics {
+			for _, m := range master.definitions() {
+				if !kept[m] {
+					m.detach()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// gatherMetrics implements prometheus.Gatherer for the current metrics
+func (s *ZServer) gatherMetrics() ([]*dto.MetricFamily, error) {
+	metrics := s.currentMetrics()
+	if metrics == nil {
+		return nil, nil
+	}
+	return metrics.registry.Gather()
+}
+
+// currentMetrics returns the metric definitions currently in use
+func (s *ZServer) currentMetrics() *metricSet {
+	metrics, _ := s.metrics.Load().(*metricSet)
+	return metrics
+}
+
+// reloadOnSignal reloads the metrics file on SIGHUP
+func (s *ZServer) reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		log.Infof("Received SIGHUP, reloading metrics file")
+		if err := s.reloadMetrics(); err != nil {
+			log.Errorf("could not reload metrics: %v", err)
+		}
+	}
+}
+
+// watchMetricsFile reloads the metrics files whenever their content changes
+// or files are added to or removed from the metrics directory
+func (s *ZServer) watchMetricsFile(interval time.Duration) {
+	hash := func() []byte {
+		paths, err := metricsFilePaths(s.Config.MetricsFile)
+		if err != nil {
+			log.Warnf("could not list metrics files: %v", err)
+			return nil
+		}
+
+		h := sha256.New()
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				log.Warnf("could not read metrics file: %v", err)
+				return nil
+			}
+			fmt.Fprintf(h, "%s\x00%d\x00", path, len(data))
+			h.Write(data)
+		}
+		return h.Sum(nil)
+	}
+
+	last := hash()
+	for range time.Tick(interval) {
+		current := hash()
+		if current == nil || bytes.Equal(current, last) {
+			continue
+		}
+		last = current
+
+		log.Infof("Metrics file changed, reloading")
+		if err := s.reloadMetrics(); err != nil {
+			log.Errorf("could not reload metrics: %v", err)
+		}
+	}
+}
+
+// reloadHandler reloads the metrics file on POST requests
+func (s *ZServer) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "only POST and PUT requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.reloadMetrics(); err != nil {
+		log.Errorf("could not reload metrics: %v", err)
+		http.Error(w, fmt.Sprintf("could not reload metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "metrics.yaml", `
+- zabbix_key: temp
+  kind: gauge
+- zabbix_key: load
+  kind: gauge
+  help: Load`)
+
+	s := newTestServer(t, &ZServerConfig{MetricsFile: path, MetricsReloadEndpoint: true}, "")
+	handler := s.Handler()
+	reload := func(method string, code int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/-/reload", nil))
+		if rec.Code != code {
+			t.Errorf("%s /-/reload status = %d, want %d: %s", method, rec.Code, code, rec.Body)
+		}
+	}
+
+	send(t, s, 2, item("h", "temp", 1), item("h", "load", 2))
+	temp := definition(t, s, "temp")
+
+	// unchanged definitions are reused with their series, changed ones
+	// start over
+	writeFile(t, dir, "metrics.yaml", `
+- zabbix_key: temp
+  kind: gauge
+- zabbix_key: load
+  kind: gauge
+  help: Load average
+- zabbix_key: fan
+  kind: gauge`)
+	reload(http.MethodPost, http.StatusOK)
+
+	if definition(t, s, "temp") != temp {
+		t.Error("unchanged definition of temp was not reused")
+	}
+	send(t, s, 1, item("h", "fan", 3))
+	expectSamples(t, s, map[string]float64{
+		`zi_temp{zabbix_sender_hostname="h"}`:       1,
+		`zi_load{zabbix_sender_hostname="h"}`:       math.NaN(),
+		`zi_fan{zabbix_sender_hostname="h"}`:        3,
+		`zi_config_reloads_total{result="success"}`: 2,
+		`zi_config_last_reload_successful`:          1,
+	})
+
+	// a broken file keeps the current definitions
+	writeFile(t, dir, "metrics.yaml", `
+- zabbix_key: temp
+  kind: gauge
+- zabbix_key: fan
+  kind: meter`)
+	reload(http.MethodPost, http.StatusInternalServerError)
+	reload(http.MethodGet, http.StatusMethodNotAllowed)
+
+	send(t, s, 2, item("h", "load", 4), item("h", "fan", 5))
+	expectSamples(t, s, map[string]float64{
+		`zi_temp{zabbix_sender_hostname="h"}`:       1,
+		`zi_load{zabbix_sender_hostname="h"}`:       4,
+		`zi_fan{zabbix_sender_hostname="h"}`:        5,
+		`zi_config_reloads_total{result="failure"}`: 1,
+		`zi_config_last_reload_successful`:          0,
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons trapper items are skipped for
+const (
+	skipNotSupported    = "not_supported"
+	skipInvalidKey      = "invalid_key"
+	skipUnknownKey      = "unknown_key"
+	skipInvalidArgs     = "invalid_args"
+	skipTooOld          = "too_old"
+	skipOutOfOrder      = "out_of_order"
+	skipNegativeCounter = "negative_counter"
+	skipDiscarded       = "discarded"
+	skipSeriesLimit     = "series_limit"
+	skipInvalidValue    = "invalid_value"
+	skipPollFailed      = "poll_failed"
+	skipUnresolved      = "unresolved"
+)
+
+var skipReasons = []string{
+	skipNotSupported, skipInvalidKey, skipUnknownKey, skipInvalidArgs, skipTooOld, skipOutOfOrder,
+	skipNegativeCounter, skipDiscarded, skipSeriesLimit, skipInvalidValue, skipPollFailed, skipUnresolved,
+}
+
+// serverMetrics holds the metrics a ZServer exposes about itself and the
+// zabbix proxies it receives data from
+type serverMetrics struct {
+	requestsProcessed     prometheus.Counter
+	requestsInvalid       prometheus.Counter
+	trapperItemsProcessed *prometheus.CounterVec
+	trapperItemsSkipped   *prometheus.CounterVec
+
+	requestBodySize prometheus.Histogram
+	requestItems    prometheus.Histogram
+	requestDuration prometheus.Histogram
+
+	connectionsAccepted prometheus.Counter
+	connectionsBlocked  prometheus.Counter
+	connectionsFailed   prometheus.Counter
+
+	configReloads              *prometheus.CounterVec
+	configLastReloadSuccessful prometheus.Gauge
+	configLastReloadSuccess    prometheus.Gauge
+
+	pollerTargetUp     *prometheus.GaugeVec
+	pollerPollDuration *prometheus.GaugeVec
+
+	discoveryEntities *prometheus.GaugeVec
+
+	seriesLimitRejected *prometheus.CounterVec
+
+	proxyLastSeen              *prometheus.GaugeVec
+	proxyHostAvailability      *prometheus.GaugeVec
+	proxyInterfaceAvailability *prometheus.GaugeVec
+	proxyDiscoveredServiceUp   *prometheus.GaugeVec
+}
+
+// newServerMetrics creates the server metrics under namespace. Self-metrics
+// are registered in self, the metrics converted from proxy data and the
+// poller target status in converted.
+func newServerMetrics(self, converted prometheus.Registerer, namespace string) *serverMetrics {
+	m := &serverMetrics{
+		requestsProcessed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "processed_requests",
+			Help:      "The total number of processed zabbix_sender requests",
+		}),
+		requestsInvalid: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "invalid_requests",
+			Help:      "The total number of invalid zabbix_sender requests",
+		}),
+		trapperItemsProcessed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "processed_trapper_items",
+			Help:      "The total number of processed trapper items by metric definition",
+		}, []string{"metric"}),
+		trapperItemsSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "skipped_trapper_items",
+			Help:      "The total number of skipped trapper items by reason",
+		}, []string{"reason"}),
+
+		requestBodySize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_body_size_bytes",
+			Help:      "Size of the (decompressed) body of the zabbix requests",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+		}),
+		requestItems: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_items",
+			Help:      "Number of items of the zabbix requests carrying data",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		requestDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time spent processing the zabbix requests",
+		}),
+
+		connectionsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "accepted_connections",
+			Help:      "The total number of connections accepted by the IP whitelist",
+		}),
+		connectionsBlocked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "blocked_connections",
+			Help:      "The total number of connections blocked by the IP whitelist",
+		}),
+		connectionsFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "failed_connections",
+			Help:      "The total number of accepted connections that failed with a TLS, read or write error",
+		}),
+
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "config_reloads_total",
+			Help:      "The total number of metrics file reloads by result",
+		}, []string{"result"}),
+		configLastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last metrics file reload succeeded",
+		}),
+		configLastReloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful metrics file reload",
+		}),
+
+		pollerTargetUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "poller_target_up",
+			Help:      "Whether the last poll of a zabbix agent succeeded",
+		}, []string{"target"}),
+		pollerPollDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "poller_poll_duration_seconds",
+			Help:      "Duration of the last poll of a zabbix agent",
+		}, []string{"target"}),
+
+		discoveryEntities: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "discovery_entities",
+			Help:      "Number of entities discovered by a low-level discovery rule for a host",
+		}, []string{"rule", "host"}),
+
+		seriesLimitRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "series_limit_rejected_items_total",
+			Help:      "The total number of items rejected because their new series would exceed a series limit, by limit",
+		}, []string{"limit"}),
+
+		proxyLastSeen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "proxy_last_seen_timestamp_seconds",
+			Help:      "Unix timestamp of the last request received from a zabbix proxy",
+		}, []string{"proxy"}),
+		proxyHostAvailability: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "proxy_host_availability",
+			Help:      "Availability of a host interface reported by a zabbix proxy (0: unknown, 1: available, 2: unavailable)",
+		}, []string{"proxy", "hostid", "interface"}),
+		proxyInterfaceAvailability: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "proxy_interface_availability",
+			Help:      "Availability of an interface reported by a zabbix proxy (0: unknown, 1: available, 2: unavailable)",
+		}, []string{"proxy", "interfaceid"}),
+		proxyDiscoveredServiceUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "proxy_discovered_service_up",
+			Help:      "Whether a service found by network discovery on a zabbix proxy is up",
+		}, []string{"proxy", "drule", "dcheck", "ip", "port"}),
+	}
+
+	self.MustRegister(
+		m.requestsProcessed,
+		m.requestsInvalid,
+		m.trapperItemsProcessed,
+		m.trapperItemsSkipped,
+		m.requestBodySize,
+		m.requestItems,
+		m.requestDuration,
+		m.connectionsAccepted,
+		m.connectionsBlocked,
+		m.connectionsFailed,
+		m.configReloads,
+		m.configLastReloadSuccessful,
+		m.configLastReloadSuccess,
+		m.pollerPollDuration,
+		m.discoveryEntities,
+		m.seriesLimitRejected,
+	)
+	converted.MustRegister(
+		m.pollerTargetUp,
+		m.proxyLastSeen,
+		m.proxyHostAvailability,
+		m.proxyInterfaceAvailability,
+		m.proxyDiscoveredServiceUp,
+	)
+
+	// expose every reason from the start so they can be alerted on
+	for _, reason := range skipReasons {
+		m.trapperItemsSkipped.WithLabelValues(reason)
+	}
+
+	return m
+}
+
+// descNameRE extracts the metric name from the description of a collector
+var descNameRE = regexp.MustCompile(`^Desc\{fqName: "([^"]*)"`)
+
+// reservingRegisterer records the names of the metrics registered through
+// it, which metric definitions cannot use
+type reservingRegisterer struct {
+	prometheus.Registerer
+	names map[string]bool
+}
+
+// Register implements prometheus.Registerer
+func (r reservingRegisterer) Register(c prometheus.Collector) error {
+	if err := r.Registerer.Register(c); err != nil {
+		return err
+	}
+
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+	for desc := range ch {
+		if m := descNameRE.FindStringSubmatch(desc.String()); m != nil {
+			r.names[m[1]] = true
+		}
+	}
+	return nil
+}
+
+// MustRegister implements prometheus.Registerer
+func (r reservingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
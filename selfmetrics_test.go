@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestServerMetricNamesAreReserved(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		definitions string
+		err         string
+	}{
+		{"self-metric", `
+- zabbix_key: requests
+  metric: processed_requests
+  kind: counter`, "metric name zi_processed_requests is reserved"},
+		{"proxy metric", `
+- zabbix_key: proxy
+  metric: proxy_host_availability
+  kind: gauge`, "metric name zi_proxy_host_availability is reserved"},
+		{"last seen gauge", `
+- zabbix_key: proxy
+  metric: proxy
+  kind: gauge
+  last_seen: true`, "metric name zi_proxy_last_seen_timestamp_seconds is reserved"},
+		{"other namespace", `
+- zabbix_key: goroutines
+  namespace: go
+  metric: goroutines
+  kind: gauge`, "metric name go_goroutines is reserved"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			path := writeFile(t, dir, "metrics.yaml", tc.definitions)
+
+			s := NewZServer(&ZServerConfig{MetricsFile: path, MetricsNamespace: "zi"})
+			if err := s.reloadMetrics(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("load error = %v, want %q", err, tc.err)
+			}
+			if problems := s.validateMetricsFiles(path); !strings.Contains(problems.Error(), tc.err) {
+				t.Errorf("validate problems = %v, want %q", problems, tc.err)
+			}
+		})
+	}
+}
+
+func TestPollerTargetUpIsConverted(t *testing.T) {
+	s := newTestServer(t, &ZServerConfig{MetricsPath: "/metrics", MetricsSelfPath: "/self"}, "[]")
+	s.selfMetrics.pollerTargetUp.WithLabelValues("agent:10050").Set(1)
+	s.selfMetrics.pollerPollDuration.WithLabelValues("agent:10050").Set(0.5)
+
+	for path, want := range map[string]string{
+		"/metrics": `zi_poller_target_up{target="agent:10050"} 1`,
+		"/self":    `zi_poller_poll_duration_seconds{target="agent:10050"} 0.5`,
+	} {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s does not expose %s:\n%s", path, want, rec.Body)
+		}
+	}
+}
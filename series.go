@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// series holds the state of a single label set exposed by a Metric
+type series struct {
+	labels []string
+	// timestamp is the sample time of the last applied value
+	timestamp time.Time
+	// last is the last applied value
+	last float64
+	// text is the last applied value of info and stateset metrics
+	text string
+	// updated is the time the series last received a value, including
+	// values discarded by preprocessing
+	updated time.Time
+	// applied is false until a value of the series passes preprocessing,
+	// series holding only preprocessing state are not exposed
+	applied bool
+	// steps holds the state of the preprocessing steps of the series
+	steps []*stepState
+}
+
+// seriesTracker keeps track of the series exposed by a Metric. Callers must
+// hold mu while using it.
+type seriesTracker struct {
+	mu     sync.Mutex
+	series map[string]*series
+	// values counts the series exposing each value of an info metric
+	values map[string]int
+	// limits counts the series shared by all the metrics
+	limits *seriesLimits
+}
+
+func newSeriesTracker(limits *seriesLimits) *seriesTracker {
+	return &seriesTracker{
+		limits: limits,
+		series: make(map[string]*series),
+		values: make(map[string]int),
+	}
+}
+
+func seriesKey(labels []string) string {
+	return strings.Join(labels, "\xff")
+}
+
+// get returns the series for labels or nil if it is not tracked yet
+func (t *seriesTracker) get(labels []string) *series {
+	return t.series[seriesKey(labels)]
+}
+
+// add starts tracking the series for labels with the state of n
+// preprocessing steps
+func (t *seriesTracker) add(labels []string, n int) *series {
+	sr := &series{
+		labels:  append([]string{}, labels...),
+		updated: time.Now(),
+		steps:   make([]*stepState, n),
+	}
+	for i := range sr.steps {
+		sr.steps[i] = &stepState{}
+	}
+	t.series[seriesKey(labels)] = sr
+	return sr
+}
+
+// holdValue records a series exposing value
+func (t *seriesTracker) holdValue(value string) {
+	t.values[value]++
+}
+
+// releaseValue records a series no longer exposing value
+func (t *seriesTracker) releaseValue(value string) {
+	if t.values[value]--; t.values[value] <= 0 {
+		delete(t.values, value)
+	}
+}
+
+// deleteSeries stops exposing the series identified by labels and forgets
+// its state
+func (m *Metric) deleteSeries(labels []string) {
+	m.series.mu.Lock()
+	defer m.series.mu.Unlock()
+
+	m.removeSeries(labels)
+}
+
+// removeSeries is deleteSeries for callers holding the series lock
+func (m *Metric) removeSeries(labels []string) {
+	sr := m.series.get(labels)
+	switch strings.ToLower(m.Kind) {
+	case "gauge":
+		m.Gauge.DeleteLabelValues(labels...)
+	case "counter":
+		m.Counter.DeleteLabelValues(labels...)
+	case "histogram":
+		m.Histogram.DeleteLabelValues(labels...)
+	case "summary":
+		m.Summary.DeleteLabelValues(labels...)
+	case "info":
+		if sr != nil && sr.applied {
+			m.Gauge.DeleteLabelValues(withValue(labels, sr.text)...)
+			m.series.releaseValue(sr.text)
+		}
+	case "stateset":
+		for _, state := range m.States {
+			m.Gauge.DeleteLabelValues(withValue(labels, state)...)
+		}
+	}
+
+	if m.lastSeenGauge != nil {
+		m.lastSeenGauge.DeleteLabelValues(labels...)
+	}
+
+	if sr != nil {
+		m.series.unreserve(labels)
+	}
+
+	delete(m.series.series, seriesKey(labels))
+}
+
+// timestampCollector exposes the series of a Metric with the timestamp of
+// their last applied sample instead of the scrape time
+type timestampCollector struct {
+	metric *Metric
+	vec    prometheus.Collector
+}
+
+// Describe implements prometheus.Collector
+func (c *timestampCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.vec.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *timestampCollector) Collect(ch chan<- prometheus.Metric) {
+	c.metric.series.mu.Lock()
+	defer c.metric.series.mu.Unlock()
+
+	for _, sr := range c.metric.series.series {
+		if !sr.applied {
+			continue
+		}
+		for _, m := range c.metric.seriesMetrics(sr) {
+			ch <- prometheus.NewMetricWithTimestamp(sr.timestamp, m)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestInfoMaxValues(t *testing.T) {
+	s := newTestServer(t, nil, `
+- zabbix_key: version
+  kind: info
+  max_values: 2`)
+
+	send(t, s, 3, item("a", "version", "1.0"), item("b", "version", "1.1"), item("c", "version", "1.1"))
+	// a third distinct value is rejected
+	send(t, s, 0, item("c", "version", "2.0"))
+	// a changing value replaces the previous one
+	send(t, s, 1, item("b", "version", "1.0"))
+	// a value held by a single series frees its slot when that series
+	// changes
+	send(t, s, 1, item("c", "version", "2.0"))
+
+	expectSamples(t, s, map[string]float64{
+		`zi_version{value="1.0",zabbix_sender_hostname="a"}`: 1,
+		`zi_version{value="1.0",zabbix_sender_hostname="b"}`: 1,
+		`zi_version{value="1.1",zabbix_sender_hostname="b"}`: math.NaN(),
+		`zi_version{value="1.1",zabbix_sender_hostname="c"}`: math.NaN(),
+		`zi_version{value="2.0",zabbix_sender_hostname="c"}`: 1,
+	})
+	if got := skipped(t, s, skipInvalidValue); got != 1 {
+		t.Errorf("%v items skipped for invalid values, want 1", got)
+	}
+}
+
+func TestStateSet(t *testing.T) {
+	s := newTestServer(t, nil, `
+- zabbix_key: status
+  kind: stateset
+  states: [up, down]
+- zabbix_key: mode
+  kind: gauge
+  value_map: {standby: 0, active: 1}`)
+
+	send(t, s, 3, item("h", "status", "up"), item("h", "status", "down"), item("h", "mode", "active"))
+	send(t, s, 0, item("h", "status", "unknown"), item("h", "mode", "off"))
+
+	expectSamples(t, s, map[string]float64{
+		`zi_status{state="up",zabbix_sender_hostname="h"}`:   0,
+		`zi_status{state="down",zabbix_sender_hostname="h"}`: 1,
+		`zi_mode{zabbix_sender_hostname="h"}`:                1,
+	})
+	if got := skipped(t, s, skipInvalidValue); got != 2 {
+		t.Errorf("%v items skipped for invalid values, want 2", got)
+	}
+}
+
+func TestTextKindErrors(t *testing.T) {
+	for _, tc := range []struct {
+		metric Metric
+		err    string
+	}{
+		{Metric{Kind: "info", MaxValues: -1}, "max_values must be positive"},
+		{Metric{Kind: "info", States: []string{"a"}}, "states are only supported by stateset metrics"},
+		{Metric{Kind: "stateset"}, "stateset metrics require states"},
+		{Metric{Kind: "stateset", States: []string{"a", "a"}}, `duplicate state "a"`},
+		{Metric{Kind: "stateset", States: []string{"a"}, MaxValues: 1}, "max_values is only supported by info metrics"},
+		{Metric{Kind: "gauge", ValueLabel: "v"}, "only supported by info and stateset metrics"},
+	} {
+		t.Run(tc.err, func(t *testing.T) {
+			if err := tc.metric.initTextKind(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// seriesExpiryInterval is the interval series are checked for expiry at
+const seriesExpiryInterval = 5 * time.Second
+
+// lastSeenSuffix is appended to the metric name to build the name of its
+// companion last seen gauge
+const lastSeenSuffix = "_last_seen_timestamp_seconds"
+
+// collectorGroup is a collector made of several collectors
+type collectorGroup []prometheus.Collector
+
+// Describe implements prometheus.Collector
+func (g collectorGroup) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range g {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (g collectorGroup) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range g {
+		c.Collect(ch)
+	}
+}
+
+// lastSeenName returns the name of the companion last seen gauge of a
+// metric, or an empty string if it is disabled
+func (s *ZServer) lastSeenName(metric *Metric) string {
+	enabled := s.Config.MetricsLastSeen
+	if metric.LastSeen != nil {
+		enabled = *metric.LastSeen
+	}
+	if !enabled {
+		return ""
+	}
+	return s.metricName(metric) + lastSeenSuffix
+}
+
+// initStaleness sets the TTL of the series of a metric and creates its
+// companion last seen gauge
+func (s *ZServer) initStaleness(metric *Metric) error {
+	metric.ttl = s.Config.MetricsSeriesTTL
+	if metric.TTL != "" {
+		ttl, err := time.ParseDuration(metric.TTL)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid ttl %q for metric %s", metric.TTL, metric.Metric)
+		}
+		metric.ttl = ttl
+	}
+
+	metric.lastSeenGauge = nil
+	if name := s.lastSeenName(metric); name != "" {
+		if s.reservedNames[name] {
+			return fmt.Errorf("metric name %s is reserved by the server metrics", name)
+		}
+		metric.lastSeenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        name,
+			Help:        fmt.Sprintf("Unix timestamp of the last value received for %s", s.metricName(metric)),
+			ConstLabels: metric.Labels,
+		}, metric.seriesLabelNames())
+		metric.collector = collectorGroup{metric.collector, metric.lastSeenGauge}
+	}
+
+	return nil
+}
+
+// expireSeries removes the series of the metric that did not receive values
+// for longer than its TTL and returns how many were removed
+func (m *Metric) expireSeries(now time.Time) int {
+	if m.ttl == 0 {
+		return 0
+	}
+
+	m.series.mu.Lock()
+	defer m.series.mu.Unlock()
+
+	var expired int
+	for _, sr := range m.series.series {
+		if now.Sub(sr.updated) > m.ttl {
+			m.removeSeries(sr.labels)
+			expired++
+		}
+	}
+	return expired
+}
+
+// expireSeriesPeriodically removes the expired series of the current
+// definitions every interval
+func (s *ZServer) expireSeriesPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		metrics := s.currentMetrics()
+		if metrics == nil {
+			continue
+		}
+		for _, master := range metrics.metrics {
+			for _, m := range master.definitions() {
+				if m.collector == nil {
+					continue
+				}
+				if expired := m.expireSeries(now); expired > 0 {
+					log.Debugf("Expired %d series of metric %s", expired, m.Metric)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// definition returns the current definition of the metric matching key
+func definition(t *testing.T, s *ZServer, key string) *Metric {
+	t.Helper()
+	k, err := ParseItemKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, _ := s.currentMetrics().lookup(k)
+	if m == nil {
+		t.Fatalf("no definition for %s", key)
+	}
+	return m
+}
+
+func TestSeriesExpiry(t *testing.T) {
+	s := newTestServer(t, &ZServerConfig{MetricsSeriesTTL: time.Minute}, `
+- zabbix_key: temp
+  kind: gauge
+  args: [id]
+  last_seen: true
+- zabbix_key: state
+  kind: gauge
+  preprocessing:
+  - type: discard_unchanged_with_heartbeat
+    params: [3600]
+- zabbix_key: uptime
+  kind: gauge
+  ttl: 0s`)
+
+	before := time.Now()
+	send(t, s, 4,
+		item("h", "temp[a]", 1),
+		item("h", "temp[b]", 2),
+		item("h", "state", 1),
+		item("h", "uptime", 1),
+	)
+	after := time.Now()
+
+	samples := gather(t, s)
+	lastSeen := samples[`zi_temp_last_seen_timestamp_seconds{id="a",zabbix_sender_hostname="h"}`]
+	if lastSeen < float64(before.UnixNano())/1e9 || lastSeen > float64(after.UnixNano())/1e9 {
+		t.Errorf("last seen = %v, want between %v and %v", lastSeen, before.Unix(), after.Unix())
+	}
+
+	temp := definition(t, s, "temp[a]")
+	state := definition(t, s, "state")
+	uptime := definition(t, s, "uptime")
+
+	if expired := temp.expireSeries(before.Add(time.Minute)); expired != 0 {
+		t.Errorf("%d series expired before the TTL", expired)
+	}
+
+	// the series of temp[a] and state last received a value 2 minutes ago
+	age := func(m *Metric, labels ...string) {
+		m.series.mu.Lock()
+		defer m.series.mu.Unlock()
+		sr := m.series.get(labels)
+		sr.updated = sr.updated.Add(-2 * time.Minute)
+	}
+	age(temp, "h", "a")
+	age(state, "h")
+	// unchanged values are discarded but keep the series alive
+	send(t, s, 0, item("h", "state", 1))
+
+	now := time.Now()
+	if expired := temp.expireSeries(now); expired != 1 {
+		t.Errorf("%d series of temp expired, want 1", expired)
+	}
+	if expired := state.expireSeries(now); expired != 0 {
+		t.Errorf("%d series of state expired, want 0", expired)
+	}
+	if expired := uptime.expireSeries(now.Add(time.Hour)); expired != 0 {
+		t.Errorf("%d series of uptime expired without ttl", expired)
+	}
+
+	expectSamples(t, s, map[string]float64{
+		`zi_temp{id="a",zabbix_sender_hostname="h"}`:                             math.NaN(),
+		`zi_temp_last_seen_timestamp_seconds{id="a",zabbix_sender_hostname="h"}`: math.NaN(),
+		`zi_temp{id="b",zabbix_sender_hostname="h"}`:                             2,
+		`zi_state{zabbix_sender_hostname="h"}`:                                   1,
+		`zi_uptime{zabbix_sender_hostname="h"}`:                                  1,
+		`zi_state_last_seen_timestamp_seconds{zabbix_sender_hostname="h"}`:       math.NaN(),
+	})
+
+	// an expired series starts over
+	send(t, s, 1, item("h", "temp[a]", 3))
+	expectSamples(t, s, map[string]float64{
+		`zi_temp{id="a",zabbix_sender_hostname="h"}`: 3,
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxValues is the default number of distinct values an info metric
+// exposes at once
+const defaultMaxValues = 100
+
+// Text returns the value of the item as a string
+func (t TrapperItem) Text() string {
+	switch v := t.Value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(t.Value)
+}
+
+// itemValue extracts the value of an item from its text: the text itself for
+// info and stateset metrics, the number, possibly translated by the value
+// map, for the others
+func (m *Metric) itemValue(text string) (float64, string, error) {
+	switch strings.ToLower(m.Kind) {
+	case "info":
+		return 1, text, nil
+	case "stateset":
+		for _, state := range m.States {
+			if state == text {
+				return 1, text, nil
+			}
+		}
+		return 0, text, fmt.Errorf("unknown state %q", text)
+	}
+
+	if value, ok := m.ValueMap[text]; ok {
+		return value, text, nil
+	}
+	value, err := parseNumber(text)
+	return value, text, err
+}
+
+// initTextKind validates the settings of info and stateset metrics
+func (m *Metric) initTextKind() error {
+	kind := strings.ToLower(m.Kind)
+	switch kind {
+	case "info":
+		if m.ValueLabel == "" {
+			m.ValueLabel = "value"
+		}
+		if m.MaxValues == 0 {
+			m.MaxValues = defaultMaxValues
+		}
+		if m.MaxValues < 0 {
+			return errors.New("max_values must be positive")
+		}
+		if len(m.States) > 0 {
+			return errors.New("states are only supported by stateset metrics")
+		}
+	case "stateset":
+		if m.ValueLabel == "" {
+			m.ValueLabel = "state"
+		}
+		if len(m.States) == 0 {
+			return errors.New("stateset metrics require states")
+		}
+		seen := make(map[string]bool)
+		for _, state := range m.States {
+			if seen[state] {
+				return fmt.Errorf("duplicate state %q", state)
+			}
+			seen[state] = true
+		}
+		if m.MaxValues != 0 {
+			return errors.New("max_values is only supported by info metrics")
+		}
+	default:
+		if m.ValueLabel != "" || len(m.States) > 0 || m.MaxValues != 0 {
+			return errors.New("value_label, states and max_values are only supported by info and stateset metrics")
+		}
+		return nil
+	}
+
+	if len(m.ValueMap) > 0 {
+		return fmt.Errorf("value_map is not supported by %s metrics", kind)
+	}
+	return nil
+}
+
+// withValue returns a copy of labels with the value label appended
+func withValue(labels []string, value string) []string {
+	return append(append(make([]string, 0, len(labels)+1), labels...), value)
+}
+
+// updateInfo exposes text as the value label of the series, replacing the
+// previous value. Callers must hold the series lock.
+func (m *Metric) updateInfo(sr *series, labels []string, text string) error {
+	if sr.applied && sr.text == text {
+		return nil
+	}
+
+	// replacing the only series exposing the previous value frees its slot
+	used := len(m.series.values)
+	if sr.applied && m.series.values[sr.text] == 1 {
+		used--
+	}
+	if m.series.values[text] == 0 && used >= m.MaxValues {
+		return fmt.Errorf("too many distinct values, the limit is %d", m.MaxValues)
+	}
+
+	if sr.applied {
+		m.Gauge.DeleteLabelValues(withValue(labels, sr.text)...)
+		m.series.releaseValue(sr.text)
+	}
+	m.Gauge.WithLabelValues(withValue(labels, text)...).Set(1)
+	m.series.holdValue(text)
+
+	return nil
+}
+
+// updateStateSet sets the gauge of the current state to 1 and the others to 0
+func (m *Metric) updateStateSet(labels []string, text string) {
+	for _, state := range m.States {
+		var value float64
+		if state == text {
+			value = 1
+		}
+		m.Gauge.WithLabelValues(withValue(labels, state)...).Set(value)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Accepted incoming connection types, as in the zabbix TLSAccept parameter
+const (
+	tlsAcceptUnencrypted = "unencrypted"
+	tlsAcceptCert        = "cert"
+)
+
+// tlsRecordTypeHandshake is the first byte of a TLS ClientHello
+const tlsRecordTypeHandshake = 0x16
+
+// tlsReloadInterval is the interval the certificate files are checked for
+// changes at
+const tlsReloadInterval = 10 * time.Second
+
+// TLSConfig defines the certificate based encryption of the trapper listener
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// CAFile is the CA bundle used to verify client certificates
+	CAFile string
+	// RequireClientCert rejects clients that do not present a certificate
+	RequireClientCert bool
+	// Accept lists the accepted connection types: unencrypted and/or cert
+	Accept []string
+	// Subject and Issuer, if set, must match the client certificate subject
+	// and issuer (in RFC 4514 format, like the tls_subject and tls_issuer
+	// zabbix host settings)
+	Subject string
+	Issuer  string
+}
+
+// accepts reports whether connections of the given type are accepted
+func (c *TLSConfig) accepts(kind string) bool {
+	for _, a := range c.Accept {
+		if a == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the TLS configuration and fills in the defaults
+func (c *TLSConfig) validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("both a certificate and a key file are required")
+	}
+	if len(c.Accept) == 0 {
+		c.Accept = []string{tlsAcceptCert}
+	}
+	for _, a := range c.Accept {
+		if a != tlsAcceptUnencrypted && a != tlsAcceptCert {
+			return fmt.Errorf("invalid accepted connection type: %s", a)
+		}
+	}
+	if (c.Subject != "" || c.Issuer != "") && c.CAFile == "" {
+		return errors.New("a CA file is required to check the client certificate subject or issuer")
+	}
+	// without a CA file client certificates would be verified against the
+	// system roots
+	if c.RequireClientCert && c.CAFile == "" {
+		return errors.New("a CA file is required to require client certificates")
+	}
+	return nil
+}
+
+// tlsReloader builds the listener tls.Config, reloading the certificate and
+// CA bundle when their files change
+type tlsReloader struct {
+	config *TLSConfig
+
+	mu        sync.Mutex
+	modTimes  map[string]time.Time
+	tlsConfig *tls.Config
+}
+
+func newTLSReloader(c *TLSConfig) (*tlsReloader, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	r := &tlsReloader{config: c, modTimes: make(map[string]time.Time)}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// changed reports whether any of the certificate files has been modified
+func (r *tlsReloader) changed() bool {
+	for _, file := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *tlsReloader) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("could not stat %s: %v", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.NoClientCert,
+	}
+
+	if r.config.CAFile != "" {
+		ca, err := ioutil.ReadFile(r.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("could not read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in CA file %s", r.config.CAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if r.config.RequireClientCert || r.config.Subject != "" || r.config.Issuer != "" {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.modTimes = modTimes
+	r.tlsConfig = tlsConfig
+	return nil
+}
+
+// watch reloads the certificate files when they change, checking them every
+// interval
+func (r *tlsReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.mu.Lock()
+		if r.changed() {
+			if err := r.reload(); err != nil {
+				log.Errorf("could not reload TLS certificates, keeping the previous ones: %v", err)
+			} else {
+				log.Infof("Reloaded TLS certificates")
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// getConfigForClient implements tls.Config.GetConfigForClient
+func (r *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.tlsConfig, nil
+}
+
+// verifyPeer checks the client certificate subject and issuer
+func (r *tlsReloader) verifyPeer(state tls.ConnectionState) error {
+	if r.config.Subject == "" && r.config.Issuer == "" {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no client certificate")
+	}
+
+	cert := state.PeerCertificates[0]
+	if r.config.Subject != "" && cert.Subject.String() != r.config.Subject {
+		return fmt.Errorf("certificate subject %q does not match %q", cert.Subject.String(), r.config.Subject)
+	}
+	if r.config.Issuer != "" && cert.Issuer.String() != r.config.Issuer {
+		return fmt.Errorf("certificate issuer %q does not match %q", cert.Issuer.String(), r.config.Issuer)
+	}
+	return nil
+}
+
+// peekedConn is a net.Conn whose first bytes have been buffered
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// acceptConn detects whether the client starts a TLS handshake, the same way
+// the zabbix server does, and returns the connection to read the request from
+func (r *tlsReloader) acceptConn(conn net.Conn) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("could not read from connection: %v", err)
+	}
+	pc := &peekedConn{Conn: conn, r: br}
+
+	if first[0] != tlsRecordTypeHandshake {
+		if !r.config.accepts(tlsAcceptUnencrypted) {
+			return nil, errors.New("unencrypted connections are not allowed")
+		}
+		return pc, nil
+	}
+
+	if !r.config.accepts(tlsAcceptCert) {
+		return nil, errors.New("certificate-based encryption is not allowed")
+	}
+
+	tlsConn := tls.Server(pc, &tls.Config{GetConfigForClient: r.getConfigForClient})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	if err := r.verifyPeer(tlsConn.ConnectionState()); err != nil {
+		return nil, fmt.Errorf("client certificate rejected: %v", err)
+	}
+
+	return tlsConn, nil
+}
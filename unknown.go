@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxUnknownKeySources is the number of hosts and IPs remembered for every
+// unknown key, the least recently seen ones are forgotten first
+const maxUnknownKeySources = 10
+
+// unknownKey is what is known about the items sent with a key name that
+// matches no metric definition
+type unknownKey struct {
+	Key string `json:"key"`
+	// LastFullKey is the last key sent, including its parameters
+	LastFullKey string    `json:"last_full_key"`
+	Count       uint64    `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	// Hosts and IPs map the sending hosts and source IPs to the time they
+	// last sent the key
+	Hosts map[string]time.Time `json:"hosts"`
+	IPs   map[string]time.Time `json:"ips"`
+}
+
+// unknownKeys is a bounded LRU cache of the unknown keys, the least
+// recently seen key is evicted first
+type unknownKeys struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+
+	// exposed is the number of most recently seen keys exposed as metric
+	exposed int
+	desc    *prometheus.Desc
+}
+
+func newUnknownKeys(size, exposed int, namespace string) *unknownKeys {
+	return &unknownKeys{
+		size:    size,
+		order:   list.New(),
+		keys:    make(map[string]*list.Element),
+		exposed: exposed,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "unknown_trapper_items_total"),
+			"The total number of trapper items received for the most recently seen unknown keys",
+			[]string{"key"}, nil,
+		),
+	}
+}
+
+// remember records a source of an unknown key, forgetting the least
+// recently seen one past maxUnknownKeySources
+func remember(sources map[string]time.Time, source string, now time.Time) {
+	sources[source] = now
+	if len(sources) <= maxUnknownKeySources {
+		return
+	}
+
+	var oldest string
+	for s, seen := range sources {
+		if oldest == "" || seen.Before(sources[oldest]) {
+			oldest = s
+		}
+	}
+	delete(sources, oldest)
+}
+
+// record records an item sent by host from ip with an unknown key and
+// reports whether the key was not in the cache yet
+func (u *unknownKeys) record(key ItemKey, fullKey, host, ip string, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	e, ok := u.keys[key.Name]
+	if ok {
+		u.order.MoveToFront(e)
+	} else {
+		e = u.order.PushFront(&unknownKey{
+			Key:       key.Name,
+			FirstSeen: now,
+			Hosts:     make(map[string]time.Time),
+			IPs:       make(map[string]time.Time),
+		})
+		u.keys[key.Name] = e
+		if u.order.Len() > u.size {
+			oldest := u.order.Back()
+			u.order.Remove(oldest)
+			delete(u.keys, oldest.Value.(*unknownKey).Key)
+		}
+	}
+
+	k := e.Value.(*unknownKey)
+	k.LastFullKey = fullKey
+	k.Count++
+	k.LastSeen = now
+	remember(k.Hosts, host, now)
+	remember(k.IPs, ip, now)
+
+	return !ok
+}
+
+// list returns copies of the cached keys, most recently seen first
+func (u *unknownKeys) list() []unknownKey {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	keys := make([]unknownKey, 0, u.order.Len())
+	for e := u.order.Front(); e != nil; e = e.Next() {
+		k := *e.Value.(*unknownKey)
+		k.Hosts = make(map[string]time.Time, len(k.Hosts))
+		for host, seen := range e.Value.(*unknownKey).Hosts {
+			k.Hosts[host] = seen
+		}
+		k.IPs = make(map[string]time.Time, len(k.IPs))
+		for ip, seen := range e.Value.(*unknownKey).IPs {
+			k.IPs[ip] = seen
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Describe implements prometheus.Collector
+func (u *unknownKeys) Describe(ch chan<- *prometheus.Desc) {
+	ch <- u.desc
+}
+
+// Collect implements prometheus.Collector. Only the most recently seen keys
+// are exposed to cap the cardinality of the metric.
+func (u *unknownKeys) Collect(ch chan<- prometheus.Metric) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var exposed int
+	for e := u.order.Front(); e != nil && exposed < u.exposed; e = e.Next() {
+		k := e.Value.(*unknownKey)
+		ch <- prometheus.MustNewConstMetric(u.desc, prometheus.CounterValue, float64(k.Count), k.Key)
+		exposed++
+	}
+}
+
+// unknownKeysHandler serves the unknown keys cache as JSON, most recently
+// seen first or by count with ?sort=count
+func (s *ZServer) unknownKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := s.unknownKeys.list()
+	switch r.URL.Query().Get("sort") {
+	case "", "last_seen":
+	case "count":
+		sort.SliceStable(keys, func(i, j int) bool {
+			return keys[i].Count > keys[j].Count
+		})
+	default:
+		http.Error(w, "sort must be last_seen or count", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(keys)
+}
+
+// skipUnknown logs an item skipped because of its unknown key. Keys are only
+// logged as warnings the first time they are recorded in the cache, to avoid
+// flooding the logs with a misconfigured sender.
+func (s *ZServer) skipUnknown(ip string, item TrapperItem, key ItemKey, now time.Time) {
+	entry := log.WithFields(log.Fields{
+		"remote_ip": ip,
+	})
+	switch {
+	case s.unknownKeys == nil:
+		entry.Warnf("Skipping unknown metric: %s", item.FullKey)
+	case s.unknownKeys.record(key, item.FullKey, item.Host, ip, now):
+		entry.Warnf("Skipping unknown metric: %s (further items with key %s are logged at debug level)", item.FullKey, key.Name)
+	default:
+		entry.Debugf("Skipping unknown metric: %s", item.FullKey)
+	}
+	s.selfMetrics.trapperItemsSkipped.WithLabelValues(skipUnknownKey).Inc()
+}
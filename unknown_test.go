@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUnknownKeysEviction(t *testing.T) {
+	u := newUnknownKeys(2, 1, "zi")
+	now := time.Unix(1000, 0)
+	record := func(key, host string, seconds int) bool {
+		k, err := ParseItemKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.record(k, key, host, "127.0.0.1", now.Add(time.Duration(seconds)*time.Second))
+	}
+
+	if !record("a[1]", "h1", 0) || !record("b", "h1", 1) {
+		t.Error("new keys reported as cached")
+	}
+	// a is seen again, so b is the least recently seen key
+	if record("a[2]", "h2", 2) {
+		t.Error("cached key reported as new")
+	}
+	if !record("c", "h1", 3) {
+		t.Error("new key reported as cached")
+	}
+
+	keys := u.list()
+	if len(keys) != 2 || keys[0].Key != "c" || keys[1].Key != "a" {
+		t.Fatalf("keys = %+v, want c and a", keys)
+	}
+	a := keys[1]
+	if a.Count != 2 || a.LastFullKey != "a[2]" || !a.FirstSeen.Equal(now) || len(a.Hosts) != 2 || len(a.IPs) != 1 {
+		t.Errorf("a = %+v", a)
+	}
+
+	// evicted keys start over
+	if !record("b", "h1", 4) {
+		t.Error("evicted key reported as cached")
+	}
+}
+
+func TestUnknownKeySources(t *testing.T) {
+	sources := make(map[string]time.Time)
+	now := time.Unix(1000, 0)
+	for i := 0; i <= maxUnknownKeySources; i++ {
+		remember(sources, fmt.Sprintf("h%d", i), now.Add(time.Duration(i)*time.Second))
+	}
+	if _, ok := sources["h0"]; ok || len(sources) != maxUnknownKeySources {
+		t.Errorf("sources = %v, want the %d most recent ones", sources, maxUnknownKeySources)
+	}
+}
+
+func TestUnknownKeysExposure(t *testing.T) {
+	s := newTestServer(t, &ZServerConfig{
+		MetricsUnknownKeysCacheSize: 3,
+		MetricsUnknownKeysExposed:   2,
+	}, `
+- zabbix_key: temp
+  kind: gauge`)
+
+	send(t, s, 0, item("h", "a", 1), item("h", "b", 1), item("h", "b", 1), item("h", "c", 1))
+
+	// only the most recently seen keys are exposed
+	expectSamples(t, s, map[string]float64{
+		`zi_unknown_trapper_items_total{key="a"}`: math.NaN(),
+		`zi_unknown_trapper_items_total{key="b"}`: 2,
+		`zi_unknown_trapper_items_total{key="c"}`: 1,
+	})
+	if got := skipped(t, s, skipUnknownKey); got != 4 {
+		t.Errorf("%v items skipped as unknown, want 4", got)
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/-/unknown-keys?sort=count", nil))
+	var keys []unknownKey
+	if err := json.NewDecoder(rec.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0].Key != "b" || keys[1].Key != "c" || keys[2].Key != "a" {
+		t.Errorf("keys = %+v, want b, c and a", keys)
+	}
+
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/-/unknown-keys?sort=key", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d for an invalid sort, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	unknownField = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+)
+
+// ValidationError is a problem found in a metrics file
+type ValidationError struct {
+	File string
+	// Index is the position of the definition in the metrics array, -1 for
+	// problems not related to a single definition
+	Index int
+	// Line and Column are 0 when the position is unknown, as for YAML files
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ValidationError) Error() string {
+	pos := e.File
+	if e.Line > 0 {
+		pos = fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column)
+	}
+	if e.Index < 0 {
+		return fmt.Sprintf("%s: %s", pos, e.Msg)
+	}
+	return fmt.Sprintf("%s: metrics[%d]: %s", pos, e.Index, e.Msg)
+}
+
+// ValidationErrors are all the problems found in a metrics file
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// position converts a byte offset in data into a line and column
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// metricsValidator checks metrics files for problems. Metric names and
+// selectors are shared by all the files it checks so clashes between files
+// are reported too.
+type metricsValidator struct {
+	server *ZServer
+	// metricNames and selectors map to the definition that first used them
+	metricNames map[string]string
+	selectors   map[string]string
+	problems    ValidationErrors
+}
+
+func (s *ZServer) newMetricsValidator() *metricsValidator {
+	return &metricsValidator{
+		server:      s,
+		metricNames: make(map[string]string),
+		selectors:   make(map[string]string),
+	}
+}
+
+// report records a problem at offset of the JSON content of f
+func (v *metricsValidator) report(f *definitionsFile, index int, offset int64, format string, args ...interface{}) {
+	e := &ValidationError{
+		File:  f.path,
+		Index: index,
+		Msg:   fmt.Sprintf(format, args...),
+	}
+	// offsets in the JSON converted from YAML do not match the source
+	if !f.yaml {
+		e.Line, e.Column = position(f.data, offset)
+	}
+	v.problems = append(v.problems, e)
+}
+
+// validateMetricsFiles reports every problem found in the metrics files
+// matched by path
+func (s *ZServer) validateMetricsFiles(path string) ValidationErrors {
+	paths, err := metricsFilePaths(path)
+	if err != nil {
+		return ValidationErrors{{File: path, Index: -1, Msg: err.Error()}}
+	}
+
+	v := s.newMetricsValidator()
+	for _, p := range paths {
+		v.validateFile(p)
+	}
+	return v.problems
+}
+
+// validateFile reads and checks a single metrics file
+func (v *metricsValidator) validateFile(path string) {
+	f, err := readMetricsFile(path)
+	if f == nil {
+		v.problems = append(v.problems, &ValidationError{File: path, Index: -1, Msg: err.Error()})
+		return
+	}
+
+	// definitions found before a syntax error are still checked
+	v.validate(f)
+	if ferr, ok := err.(*definitionsFileError); ok {
+		v.report(f, -1, ferr.offset, "%v", ferr)
+	} else if err != nil {
+		v.report(f, -1, 0, "%v", err)
+	}
+}
+
+// validate checks the definitions of a parsed metrics file: unknown fields,
+// invalid definitions, invalid metric and label names and definitions
+// clashing with each other
+func (v *metricsValidator) validate(f *definitionsFile) {
+	for index, el := range f.elements {
+		offset := el.offset
+		where := fmt.Sprintf("%s metrics[%d]", f.path, index)
+
+		metric := &Metric{}
+		strict := json.NewDecoder(bytes.NewReader(el.raw))
+		strict.DisallowUnknownFields()
+		if err := strict.Decode(metric); err != nil {
+			switch e := err.(type) {
+			case *json.UnmarshalTypeError:
+				v.report(f, index, offset+e.Offset, "invalid value for field %s: %v", e.Field, err)
+			default:
+				errOffset := offset
+				if m := unknownField.FindStringSubmatch(err.Error()); m != nil {
+					errOffset += int64(bytes.Index(el.raw, []byte(`"`+m[1]+`"`)))
+				}
+				v.report(f, index, errOffset, "%v", err)
+			}
+			continue
+		}
+		f.defaults.apply(metric)
+
+		if err := v.server.initMetric(metric); err != nil {
+			v.report(f, index, offset, "%v", err)
+			continue
+		}
+
+		if metric.collector != nil {
+			v.checkNames(f, index, offset, metric, "", where)
+		}
+		for i, dep := range metric.Dependent {
+			v.checkNames(f, index, offset, dep, fmt.Sprintf("dependent[%d]: ", i), fmt.Sprintf("%s.dependent[%d]", where, i))
+		}
+		for i, proto := range metric.Prototypes {
+			v.checkNames(f, index, offset, proto, fmt.Sprintf("prototypes[%d]: ", i), fmt.Sprintf("%s.prototypes[%d]", where, i))
+		}
+
+		selector := metric.selector()
+		if first, ok := v.selectors[selector]; ok {
+			v.report(f, index, offset, "duplicate definition for %s, already defined by %s", metric.keyDescription(), first)
+		} else {
+			v.selectors[selector] = where
+		}
+	}
+}
+
+// checkNames reports invalid or clashing metric and label names of a metric
+func (v *metricsValidator) checkNames(f *definitionsFile, index int, offset int64, metric *Metric, prefix, where string) {
+	name := v.server.metricName(metric)
+	if !metricNameRE.MatchString(name) {
+		v.report(f, index, offset, "%sinvalid metric name %s", prefix, name)
+	}
+	names := []string{name}
+	if lastSeen := v.server.lastSeenName(metric); lastSeen != "" {
+		names = append(names, lastSeen)
+	}
+	for _, name := range names {
+		if first, ok := v.metricNames[name]; ok {
+			v.report(f, index, offset, "%sduplicate metric name %s, already used by %s", prefix, name, first)
+		} else {
+			v.metricNames[name] = where
+		}
+	}
+
+	labels := make(map[string]bool)
+	constLabels := make([]string, 0, len(metric.Labels))
+	for label := range metric.Labels {
+		constLabels = append(constLabels, label)
+	}
+	sort.Strings(constLabels)
+	for i, label := range append(metric.labelNames(), constLabels...) {
+		switch {
+		case i > 0 && label == "zabbix_sender_hostname":
+			v.report(f, index, offset, "%slabel %s is reserved", prefix, label)
+		case !labelNameRE.MatchString(label) || strings.HasPrefix(label, "__"):
+			v.report(f, index, offset, "%sinvalid label name %q", prefix, label)
+		case labels[label]:
+			v.report(f, index, offset, "%sduplicate label name %s", prefix, label)
+		}
+		labels[label] = true
+	}
+}
+
+// selector identifies the keys a definition accepts: definitions with the
+// same selector shadow each other
+func (m *Metric) selector() string {
+	var matchArgs []string
+	for name, value := range m.MatchArgs {
+		matchArgs = append(matchArgs, name+"="+value)
+	}
+	sort.Strings(matchArgs)
+
+	return fmt.Sprintf("%s|%d-%d|%s", m.keyDescription(), m.requiredArgs, len(m.Args), strings.Join(matchArgs, ","))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateMetricsFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "a.json", `[
+  {"zabbix_key": "temp", "kind": "gauge"},
+  {"zabbix_key": "temp", "kind": "gauge", "metric": "temp2"},
+  {"zabbix_key": "load", "kind": "gauge", "unit": "s"},
+  {"zabbix_key": "fan", "kind": "meter"},
+  {"zabbix_key": "up", "kind": "gauge", "metric": "up-time"},
+  {"zabbix_key": "disk", "kind": "gauge", "args": ["zabbix_sender_hostname"], "labels": {"__x": "y"}},
+  {"zabbix_key": "mem", "kind": "gauge", "buckets": "x"}
+  {"zabbix_key": "late", "kind": "gauge"}
+]`)
+	writeFile(t, dir, "b.yaml", `
+- zabbix_key: other
+  metric: temp
+  kind: gauge
+`)
+
+	// every problem is reported, with its position in JSON files
+	want := []string{
+		"a.json:3:3: metrics[1]: duplicate definition for zabbix key temp, already defined by a.json metrics[0]",
+		`a.json:4:43: metrics[2]: json: unknown field "unit"`,
+		"a.json:5:3: metrics[3]: invalid metric kind: meter",
+		"a.json:6:3: metrics[4]: invalid metric name zi_up-time",
+		"a.json:7:3: metrics[5]: label zabbix_sender_hostname is reserved",
+		`a.json:7:3: metrics[5]: invalid label name "__x"`,
+		"a.json:8:56: metrics[6]: invalid value for field buckets: json: cannot unmarshal string into Go struct field Metric.buckets of type []float64",
+		"a.json:9:4: invalid character '{' after array element",
+		"b.yaml: metrics[0]: duplicate metric name zi_temp, already used by a.json metrics[0]",
+	}
+	problems := newTestServer(t, nil, "[]").validateMetricsFiles(filepath.Join(dir, "*"))
+	got := strings.Split(strings.Replace(problems.Error(), dir+string(filepath.Separator), "", -1), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("got %d problems, want %d:\n%s", len(got), len(want), strings.Join(got, "\n"))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("problem %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	if problems := newTestServer(t, nil, "[]").validateMetricsFiles(filepath.Join(dir, "b.yaml")); len(problems) != 0 {
+		t.Errorf("valid file reported problems: %v", problems)
+	}
+	if problems := newTestServer(t, nil, "[]").validateMetricsFiles(filepath.Join(dir, "*.yml")); len(problems) != 1 {
+		t.Errorf("got %d problems for a glob matching no file, want 1", len(problems))
+	}
+}
@@ -2,25 +2,202 @@ package main
 
 import (
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
 )
 
+// Zabbix protocol header flags
+const (
+	zabbixFlagProtocol    byte = 0x01
+	zabbixFlagCompression byte = 0x02
+	zabbixFlagLargePacket byte = 0x04
+)
+
+const (
+	// zabbixMaxDataLen is the maximum size of a (decompressed) packet body,
+	// the same limit the zabbix server enforces (ZBX_MAX_RECV_DATA_SIZE)
+	zabbixMaxDataLen = 128 * 1024 * 1024
+	// defaultMaxBodySize is the default maximum size of a request body, low
+	// enough for a few concurrent requests to fit the memory of the pod
+	defaultMaxBodySize = 16 * 1024 * 1024
+)
+
+var zabbixMagic = []byte("ZBXD")
+
+// zabbixHeader is the parsed header of a zabbix protocol packet
+type zabbixHeader struct {
+	Flags byte
+	// DataLen is the length of the body as sent on the wire
+	DataLen uint64
+	// ReservedLen is the uncompressed body length for compressed packets
+	ReservedLen uint64
+}
+
+// Compressed reports whether the packet body is zlib compressed
+func (h zabbixHeader) Compressed() bool {
+	return h.Flags&zabbixFlagCompression != 0
+}
+
 func sanitizeKey(key string) string {
 	return strings.Replace(key, ".", "_", -1)
 }
 
+// readZabbixPacket reads a single length-delimited zabbix protocol packet
+// and returns its header and (decompressed) body
+func readZabbixPacket(r io.Reader, maxLen uint64) (zabbixHeader, []byte, error) {
+	var h zabbixHeader
+
+	prefix := make([]byte, len(zabbixMagic)+1)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return h, nil, fmt.Errorf("could not read header: %v", err)
+	}
+
+	if !bytes.HasPrefix(prefix, zabbixMagic) {
+		return h, nil, errors.New("incorrect header prefix")
+	}
+
+	h.Flags = prefix[len(zabbixMagic)]
+	if h.Flags&zabbixFlagProtocol == 0 ||
+		h.Flags&^(zabbixFlagProtocol|zabbixFlagCompression|zabbixFlagLargePacket) != 0 {
+		return h, nil, fmt.Errorf("unsupported protocol flags: 0x%02x", h.Flags)
+	}
+
+	// datalen and reserved are 4 bytes each, or 8 bytes for large packets
+	sizes := make([]byte, 8)
+	if h.Flags&zabbixFlagLargePacket != 0 {
+		sizes = make([]byte, 16)
+	}
+	if _, err := io.ReadFull(r, sizes); err != nil {
+		return h, nil, fmt.Errorf("could not read header: %v", err)
+	}
+
+	if len(sizes) == 16 {
+		h.DataLen = binary.LittleEndian.Uint64(sizes[:8])
+		h.ReservedLen = binary.LittleEndian.Uint64(sizes[8:])
+	} else {
+		h.DataLen = uint64(binary.LittleEndian.Uint32(sizes[:4]))
+		h.ReservedLen = uint64(binary.LittleEndian.Uint32(sizes[4:]))
+	}
+
+	if h.DataLen > maxLen {
+		return h, nil, fmt.Errorf("body too large: %d bytes", h.DataLen)
+	}
+
+	// the body buffer grows as data arrives instead of allocating the length
+	// announced by the (unauthenticated) header upfront
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(h.DataLen)); err != nil {
+		return h, nil, fmt.Errorf("could not read body: %v", err)
+	}
+
+	body, err := decodeZabbixBody(h, buf.Bytes(), maxLen)
+	if err != nil {
+		return h, nil, err
+	}
+
+	return h, body, nil
+}
+
+// decodeZabbixBody returns the body of a packet, inflating it if needed
+func decodeZabbixBody(h zabbixHeader, body []byte, maxLen uint64) ([]byte, error) {
+	if !h.Compressed() {
+		return body, nil
+	}
+
+	if h.ReservedLen > maxLen {
+		return nil, fmt.Errorf("uncompressed body too large: %d bytes", h.ReservedLen)
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress body: %v", err)
+	}
+	defer zr.Close()
+
+	// read one byte past the announced size, which is within maxLen, to
+	// detect bodies lying about their size
+	data, err := ioutil.ReadAll(io.LimitReader(zr, int64(h.ReservedLen)+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress body: %v", err)
+	}
+	if uint64(len(data)) != h.ReservedLen {
+		return nil, fmt.Errorf("uncompressed body len %d does not match header len %d", len(data), h.ReservedLen)
+	}
+
+	return data, nil
+}
+
+// zabbixPacket frames data with a zabbix header, compressing it if the
+// compression flag is set and using 64-bit sizes if the large packet flag is
+// set
+func zabbixPacket(flags byte, data []byte) ([]byte, error) {
+	payload := data
+	if flags&zabbixFlagCompression != 0 {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(data); err != nil {
+			return nil, fmt.Errorf("could not compress data: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("could not compress data: %v", err)
+		}
+		payload = compressed.Bytes()
+	}
+
+	var size []byte
+	if flags&zabbixFlagLargePacket != 0 {
+		size = make([]byte, 16)
+		binary.LittleEndian.PutUint64(size[:8], uint64(len(payload)))
+		if flags&zabbixFlagCompression != 0 {
+			binary.LittleEndian.PutUint64(size[8:], uint64(len(data)))
+		}
+	} else {
+		size = make([]byte, 8)
+		binary.LittleEndian.PutUint32(size[:4], uint32(len(payload)))
+		if flags&zabbixFlagCompression != 0 {
+			binary.LittleEndian.PutUint32(size[4:], uint32(len(data)))
+		}
+	}
+
+	buf := bytes.NewBuffer(append(append([]byte{}, zabbixMagic...), flags))
+	buf.Write(size)
+	buf.Write(payload)
+
+	return buf.Bytes(), nil
+}
+
 func zabbixResponse(processed, failed, total int, seconds float64) []byte {
 	responseString := fmt.Sprintf(`{"response": "success", "info": "processed: %d; failed: %d; total: %d; seconds spent: %f"}`,
 		processed, failed, total, seconds)
 
-	size := make([]byte, 8)
-	binary.LittleEndian.PutUint64(size, uint64(len(responseString)))
+	return []byte(responseString)
+}
 
-	buf := bytes.NewBuffer([]byte("ZBXD\x01"))
-	buf.Write(size)
-	buf.WriteString(responseString)
+func zabbixSuccessResponse() []byte {
+	return []byte(`{"response":"success"}`)
+}
+
+func zabbixFailedResponse(info string) []byte {
+	response, _ := json.Marshal(map[string]string{
+		"response": "failed",
+		"info":     info,
+	})
+
+	return response
+}
 
-	return buf.Bytes()
+func zabbixActiveChecksResponse(items []activeCheckItem) ([]byte, error) {
+	return json.Marshal(struct {
+		Response string            `json:"response"`
+		Data     []activeCheckItem `json:"data"`
+	}{
+		Response: "success",
+		Data:     items,
+	})
 }
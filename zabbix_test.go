@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestZabbixPacketRoundTrip(t *testing.T) {
+	data := []byte(`{"request":"sender data","data":[{"host":"h","key":"k","value":"1"}]}`)
+
+	for _, tc := range []struct {
+		name      string
+		flags     byte
+		headerLen int
+	}{
+		{"plain", zabbixFlagProtocol, 13},
+		{"compressed", zabbixFlagProtocol | zabbixFlagCompression, 13},
+		{"large", zabbixFlagProtocol | zabbixFlagLargePacket, 21},
+		{"large compressed", zabbixFlagProtocol | zabbixFlagCompression | zabbixFlagLargePacket, 21},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			packet, err := zabbixPacket(tc.flags, data)
+			if err != nil {
+				t.Fatalf("zabbixPacket: %v", err)
+			}
+			if !bytes.HasPrefix(packet, append(append([]byte{}, zabbixMagic...), tc.flags)) {
+				t.Fatalf("packet starts with %q", packet[:5])
+			}
+
+			h, body, err := readZabbixPacket(bytes.NewReader(packet), uint64(len(packet)))
+			if err != nil {
+				t.Fatalf("readZabbixPacket: %v", err)
+			}
+			if h.Flags != tc.flags {
+				t.Errorf("flags = 0x%02x, want 0x%02x", h.Flags, tc.flags)
+			}
+			if h.DataLen != uint64(len(packet)-tc.headerLen) {
+				t.Errorf("DataLen = %d, want %d", h.DataLen, len(packet)-tc.headerLen)
+			}
+			if h.Compressed() && h.ReservedLen != uint64(len(data)) {
+				t.Errorf("ReservedLen = %d, want %d", h.ReservedLen, len(data))
+			}
+			if !bytes.Equal(body, data) {
+				t.Errorf("body = %q, want %q", body, data)
+			}
+		})
+	}
+}
+
+// header builds a zabbix header with 32-bit sizes
+func header(flags byte, dataLen, reservedLen uint32) []byte {
+	h := append(append([]byte{}, zabbixMagic...), flags)
+	sizes := make([]byte, 8)
+	binary.LittleEndian.PutUint32(sizes[:4], dataLen)
+	binary.LittleEndian.PutUint32(sizes[4:], reservedLen)
+	return append(h, sizes...)
+}
+
+func TestReadZabbixPacketErrors(t *testing.T) {
+	compressed, err := zabbixPacket(zabbixFlagProtocol|zabbixFlagCompression, bytes.Repeat([]byte("a"), 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// announce a smaller uncompressed size than the actual one
+	lying := append([]byte{}, compressed...)
+	binary.LittleEndian.PutUint32(lying[9:13], 10)
+
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		maxLen uint64
+		err    string
+	}{
+		{"short header", []byte("ZBX"), 100, "could not read header"},
+		{"bad magic", append([]byte("ABCD\x01"), make([]byte, 8)...), 100, "incorrect header prefix"},
+		{"no protocol flag", header(0x00, 0, 0), 100, "unsupported protocol flags"},
+		{"unknown flag", header(zabbixFlagProtocol|0x08, 0, 0), 100, "unsupported protocol flags"},
+		{"oversize header", header(zabbixFlagProtocol, 1<<31, 0), 1024, "body too large"},
+		{"oversize large packet header", append([]byte("ZBXD\x05"), bytes.Repeat([]byte{0xff}, 16)...), 1024, "body too large"},
+		{"truncated body", append(header(zabbixFlagProtocol, 10, 0), "abc"...), 100, "could not read body"},
+		{"oversize uncompressed size", header(zabbixFlagProtocol|zabbixFlagCompression, 0, 1000), 100, "uncompressed body too large"},
+		{"lying uncompressed size", lying, 1000, "does not match header len"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := readZabbixPacket(bytes.NewReader(tc.packet), tc.maxLen)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
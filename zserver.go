@@ -1,359 +1,969 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
-	"strconv"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	requestsProcessed = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "processed_requests",
-		Help: "The total number of processed zabbix_sender requests",
-	})
-	requestsInvalid = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "invalid_requests",
-		Help: "The total number of invalid zabbix_sender requests",
-	})
-	trapperItemsProcessed = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "processed_trapper_items",
-		Help: "The total number of processed trapper items",
-	})
-	trapperItemsSkipped = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "skipped_trapper_items",
-		Help: "The total number of skipped trapper items",
-	})
-)
-
 // TrapperItem TODO
 type TrapperItem struct {
 	Host    string      `json:"host"`
 	FullKey string      `json:"key"`
 	Value   interface{} `json:"value"`
+	Clock   int64       `json:"clock"`
+	NS      int64       `json:"ns"`
+	// State is set to 1 by agents for unsupported items
+	State int `json:"state"`
 }
 
-// Key TODO
-func (t TrapperItem) Key() string {
-	bracketIndex := strings.Index(t.FullKey, "[")
-
-	if bracketIndex == -1 {
-		return t.FullKey
+// Timestamp returns the time the item was collected at, or received if the
+// sender did not provide a clock
+func (t TrapperItem) Timestamp(received time.Time) time.Time {
+	if t.Clock == 0 {
+		return received
 	}
+	return time.Unix(t.Clock, t.NS)
+}
 
-	return t.FullKey[:bracketIndex]
+// ParseKey parses the item key into its name and parameters
+func (t TrapperItem) ParseKey() (ItemKey, error) {
+	return ParseItemKey(t.FullKey)
 }
 
-// Args TODO
-func (t TrapperItem) Args() []string {
-	bracketIndex := strings.Index(t.FullKey, "[")
+// Zabbix request types
+const (
+	requestSenderData   = "sender data"
+	requestAgentData    = "agent data"
+	requestActiveChecks = "active checks"
+)
 
-	if bracketIndex == -1 {
-		return []string{}
-	}
+// Request TODO
+type Request struct {
+	Request string        `json:"request"`
+	Host    string        `json:"host"`
+	Data    []TrapperItem `json:"data"`
+}
+
+// Counter modes
+const (
+	counterModeDelta    = "delta"
+	counterModeAbsolute = "absolute"
+)
 
-	args := t.FullKey[bracketIndex+1 : len(t.FullKey)-1]
-	return strings.Split(args, ",")
+// Metric TODO
+type Metric struct {
+	ZabbixKey string `json:"zabbix_key"`
+	// ZabbixKeyGlob and ZabbixKeyRegex match families of key names, their
+	// named captures become labels
+	ZabbixKeyGlob  string   `json:"zabbix_key_glob"`
+	ZabbixKeyRegex string   `json:"zabbix_key_regex"`
+	Metric         string   `json:"metric"`
+	Help           string   `json:"help"`
+	Args           []string `json:"args"`
+	// MatchArgs selects this definition among the ones sharing a key by the
+	// literal value of some args, which are not exposed as labels
+	MatchArgs map[string]string `json:"match_args"`
+	// Defaults fills in optional trailing args missing from the key
+	Defaults map[string]string `json:"defaults"`
+	// Namespace overrides the server namespace of the metric name
+	Namespace string `json:"namespace"`
+	// Labels are constant labels added to every series
+	Labels map[string]string `json:"labels"`
+
+	Kind string `json:"kind"`
+	// CounterMode is how counters apply the values: as increments (delta,
+	// the default) or as cumulative totals (absolute)
+	CounterMode string `json:"counter_mode"`
+	// Buckets, ExponentialBuckets and LinearBuckets define the buckets of
+	// histograms
+	Buckets            []float64         `json:"buckets"`
+	ExponentialBuckets *BucketsGenerator `json:"exponential_buckets"`
+	LinearBuckets      *BucketsGenerator `json:"linear_buckets"`
+	// Objectives maps the quantiles of summaries to their allowed error
+	Objectives map[string]float64 `json:"objectives"`
+	// MaxAge is the duration observations are kept for by summaries
+	MaxAge string `json:"max_age"`
+	// ValueLabel is the label exposing the value of info and stateset
+	// metrics
+	ValueLabel string `json:"value_label"`
+	// States are the values a stateset metric accepts
+	States []string `json:"states"`
+	// MaxValues caps the distinct values an info metric exposes at once
+	MaxValues int `json:"max_values"`
+	// ValueMap translates text values to numbers
+	ValueMap map[string]float64 `json:"value_map"`
+	// Preprocessing transforms the values before they are applied
+	Preprocessing []*PreprocessingStep `json:"preprocessing"`
+	// Dependent metrics extract their values from the JSON value of this
+	// metric
+	Dependent []*Metric `json:"dependent"`
+	// Path, ValuePath and ElementLabels are the JSONPaths extracting the
+	// values and labels of dependent metrics
+	Path          string            `json:"path"`
+	ValuePath     string            `json:"value_path"`
+	ElementLabels map[string]string `json:"element_labels"`
+	// Prototypes are the item prototypes of a discovery rule, the macros of
+	// their keys are exposed as labels
+	Prototypes []*Metric `json:"prototypes"`
+	// KeepLostResources is how long entities that are no longer discovered
+	// are kept for
+	KeepLostResources string `json:"keep_lost_resources"`
+	// TTL is how long series are kept without receiving values,
+	// --metrics.series-ttl if empty
+	TTL string `json:"ttl"`
+	// LastSeen exposes the time every series last received a value as a
+	// companion gauge, --metrics.last-seen if unset
+	LastSeen *bool `json:"last_seen"`
+	// MaxSeries caps the number of series of the metric,
+	// --metrics.max-series-per-metric if 0
+	MaxSeries int                      `json:"max_series"`
+	Active    *ActiveCheck             `json:"active"`
+	Gauge     *prometheus.GaugeVec     `json:"-"`
+	Counter   *prometheus.CounterVec   `json:"-"`
+	Histogram *prometheus.HistogramVec `json:"-"`
+	Summary   *prometheus.SummaryVec   `json:"-"`
+
+	series *seriesTracker
+	// master is the metric a dependent metric extracts its values from
+	master        *Metric
+	path          *jsonPath
+	valuePath     *jsonPath
+	elementLabels []string
+	elementPaths  map[string]*jsonPath
+	// discovery holds the entities discovered by a discovery rule
+	discovery         *discoveryState
+	keepLostResources time.Duration
+	// macros are the LLD macros of an item prototype key
+	macros      []string
+	macroLabels []string
+	keyRegexp   *regexp.Regexp
+	captures    []string
+	// requiredArgs is the number of args without a default
+	requiredArgs int
+	// prototypeKey is the parsed key of an item prototype
+	prototypeKey ItemKey
+	// fingerprint identifies the definition the metric was built from
+	fingerprint   string
+	collector     prometheus.Collector
+	ttl           time.Duration
+	lastSeenGauge *prometheus.GaugeVec
+	maxSeries     int
 }
 
-// ParseFloat64 TODO
-func (t TrapperItem) ParseFloat64() (float64, error) {
-	var value float64
-	var err error
+// errNegativeCounter signals a negative value received for a counter
+var errNegativeCounter = errors.New("received negative value for counter")
 
-	switch v := t.Value.(type) {
-	case string:
-		value, err = strconv.ParseFloat(v, 64)
-		if err != nil {
-			return value, fmt.Errorf("cannot parse %s", v)
-		}
-	case int:
-		value = float64(v)
-	case float32:
-		value = float64(v)
-	case float64:
-		value = float64(v)
-	default:
-		return value, errors.New("invalid type")
+// outOfOrderError signals a sample older than the last applied sample of
+// its series
+type outOfOrderError struct {
+	ts, last time.Time
+}
+
+func (e *outOfOrderError) Error() string {
+	return fmt.Sprintf("sample from %s is older than the last applied sample from %s",
+		e.ts.Format(time.RFC3339), e.last.Format(time.RFC3339))
+}
+
+// skipReason returns the reason an item is skipped for because of err
+func skipReason(err error) string {
+	switch err.(type) {
+	case *discardedError:
+		return skipDiscarded
+	case *seriesLimitError:
+		return skipSeriesLimit
+	case *outOfOrderError:
+		return skipOutOfOrder
+	}
+	if err == errNegativeCounter {
+		return skipNegativeCounter
+	}
+	return skipInvalidValue
+}
+
+// update applies a value collected at ts to the series identified by labels
+func (m *Metric) update(labels []string, text string, ts time.Time) error {
+	m.series.mu.Lock()
+	defer m.series.mu.Unlock()
+
+	// every value observed by histograms and summaries is a distinct event,
+	// so they accept values older than the last one
+	observe := m.Histogram != nil || m.Summary != nil
+
+	sr := m.series.get(labels)
+	if sr != nil && ts.Before(sr.timestamp) && !observe {
+		return &outOfOrderError{ts: ts, last: sr.timestamp}
+	}
+
+	created := sr == nil
+	if created {
+		if err := m.series.reserve(labels, m.maxSeries); err != nil {
+			return err
+		}
+		// the series holds the reservation and the preprocessing state
+		sr = m.series.add(labels, len(m.Preprocessing))
+	}
+
+	err := m.apply(sr, text, ts)
+	if _, discarded := err.(*discardedError); err != nil && !discarded {
+		if created {
+			// the reservation is returned if the first value is invalid
+			m.removeSeries(labels)
+		}
+		return err
 	}
 
-	return value, nil
+	// values discarded by preprocessing, e.g. unchanged ones, still keep
+	// the series alive
+	sr.updated = time.Now()
+	if m.lastSeenGauge != nil && sr.applied {
+		m.lastSeenGauge.WithLabelValues(labels...).Set(float64(sr.updated.UnixNano()) / 1e9)
+	}
+	return err
 }
 
-// Request TODO
-type Request struct {
-	Data []TrapperItem `json:"data"`
+// apply preprocesses a value of the series sr and applies it to the metric.
+// Callers must hold the series lock.
+func (m *Metric) apply(sr *series, text string, ts time.Time) error {
+	labels := sr.labels
+	text, err := m.preprocess(sr, text, ts)
+	if err != nil {
+		return err
+	}
+	value, text, err := m.itemValue(text)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(m.Kind) {
+	case "gauge":
+		m.Gauge.WithLabelValues(labels...).Set(value)
+	case "counter":
+		if value < 0 {
+			return errNegativeCounter
+		}
+		increase := value
+		if m.CounterMode == counterModeAbsolute && sr.applied {
+			// the value is the client side total, a decrease is a reset
+			if value >= sr.last {
+				increase = value - sr.last
+			}
+		}
+		m.Counter.WithLabelValues(labels...).Add(increase)
+	case "histogram":
+		m.Histogram.WithLabelValues(labels...).Observe(value)
+	case "summary":
+		m.Summary.WithLabelValues(labels...).Observe(value)
+	case "info":
+		if err := m.updateInfo(sr, labels, text); err != nil {
+			return err
+		}
+	case "stateset":
+		m.updateStateSet(labels, text)
+	}
+
+	sr.applied = true
+	if ts.After(sr.timestamp) {
+		sr.timestamp = ts
+	}
+	sr.last = value
+	sr.text = text
+
+	return nil
 }
 
-// Metric TODO
-type Metric struct {
-	ZabbixKey string                 `json:"zabbix_key"`
-	Metric    string                 `json:"metric"`
-	Help      string                 `json:"help"`
-	Args      []string               `json:"args"`
-	Kind      string                 `json:"kind"`
-	Gauge     *prometheus.GaugeVec   `json:"-"`
-	Counter   *prometheus.CounterVec `json:"-"`
+// seriesMetrics returns the prometheus metrics of a series
+func (m *Metric) seriesMetrics(sr *series) []prometheus.Metric {
+	switch strings.ToLower(m.Kind) {
+	case "gauge":
+		return []prometheus.Metric{m.Gauge.WithLabelValues(sr.labels...)}
+	case "counter":
+		return []prometheus.Metric{m.Counter.WithLabelValues(sr.labels...)}
+	case "histogram":
+		return []prometheus.Metric{m.Histogram.WithLabelValues(sr.labels...).(prometheus.Metric)}
+	case "summary":
+		return []prometheus.Metric{m.Summary.WithLabelValues(sr.labels...).(prometheus.Metric)}
+	case "info":
+		return []prometheus.Metric{m.Gauge.WithLabelValues(withValue(sr.labels, sr.text)...)}
+	case "stateset":
+		metrics := make([]prometheus.Metric, len(m.States))
+		for i, state := range m.States {
+			metrics[i] = m.Gauge.WithLabelValues(withValue(sr.labels, state)...)
+		}
+		return metrics
+	}
+	return nil
 }
 
 // ZServer defines a zabbix server that will receive trapper requests
 type ZServer struct {
-	Config  *ZServerConfig
-	Metrics map[string]Metric
+	Config *ZServerConfig
+
+	// metrics holds the current *metricSet, swapped on reloads
+	metrics  atomic.Value
+	reloadMu sync.Mutex
+	poller   *poller
+
+	// registry holds the metrics converted from zabbix data that do not
+	// come from metric definitions, selfRegistry the server self-metrics
+	registry     *prometheus.Registry
+	selfRegistry *prometheus.Registry
+	selfMetrics  *serverMetrics
+	// reservedNames are the names of the server metrics
+	reservedNames map[string]bool
+	// limits counts the series of all the metrics
+	limits *seriesLimits
+	// unknownKeys caches the keys matching no definition, if enabled
+	unknownKeys *unknownKeys
+	// proxyItems resolves the itemids of the values sent by zabbix proxies
+	proxyItems map[uint64]ProxyItem
 }
 
 // ZServerConfig defines a ZServer configuration
 type ZServerConfig struct {
-	ServerListenAddress  string
-	ServerListenPort     int64
-	ServerIPWhitelist    []*net.IP
-	ServerCIDRWhitelist  []*net.IPNet
+	// Listeners are the ports zabbix requests are accepted on
+	Listeners            []*ListenerConfig
+	ServerMaxBodySize    uint64
+	ServerReadTimeout    time.Duration
+	ServerWriteTimeout   time.Duration
 	MetricsListenAddress string
 	MetricsListenPort    int64
-	MetricsFile          string
-	MetricsNamespace     string
+	// MetricsPath is the path the converted metrics are served on
+	MetricsPath string
+	// MetricsSelfPath is the path the self-metrics are served on. They are
+	// served along the converted metrics if empty.
+	MetricsSelfPath  string
+	MetricsFile      string
+	MetricsNamespace string
+	// MetricsHonorTimestamps exposes samples with the clock sent by the client
+	MetricsHonorTimestamps bool
+	// MetricsMaxItemAge rejects items whose clock is older than this, if set
+	MetricsMaxItemAge time.Duration
+	// MetricsReloadInterval is the interval the metrics file is checked for
+	// changes at. Changes are not watched if zero.
+	MetricsReloadInterval time.Duration
+	// MetricsSeriesTTL is how long series are kept without receiving values
+	// by default, 0 keeps them forever
+	MetricsSeriesTTL time.Duration
+	// MetricsLastSeen exposes the companion last seen gauges by default
+	MetricsLastSeen bool
+	// MetricsMaxSeries, MetricsMaxSeriesPerMetric and MetricsMaxSeriesPerHost
+	// cap the number of series, 0 disables a limit
+	MetricsMaxSeries          int
+	MetricsMaxSeriesPerMetric int
+	MetricsMaxSeriesPerHost   int
+	// MetricsUnknownKeysCacheSize is the number of unknown keys cached, 0
+	// disables the cache
+	MetricsUnknownKeysCacheSize int
+	// MetricsUnknownKeysExposed is the number of most recently seen unknown
+	// keys exposed as metric
+	MetricsUnknownKeysExposed int
+	// MetricsReloadEndpoint enables reloading the metrics file with a POST
+	// request to /-/reload
+	MetricsReloadEndpoint bool
+	// PollerFile defines the zabbix agents to poll with passive checks
+	PollerFile string
+	// ProxyItemMapFile maps the itemids sent by zabbix proxies to their host
+	// and key
+	ProxyItemMapFile string
 }
 
 // NewZServer instantiates a new ZServer
 func NewZServer(c *ZServerConfig) *ZServer {
-	return &ZServer{Config: c}
+	if c.ServerMaxBodySize == 0 {
+		c.ServerMaxBodySize = defaultMaxBodySize
+	}
+	// zabbix servers do not accept larger bodies either
+	if c.ServerMaxBodySize > zabbixMaxDataLen {
+		c.ServerMaxBodySize = zabbixMaxDataLen
+	}
+	if c.MetricsPath == "" {
+		c.MetricsPath = "/metrics"
+	}
+
+	s := &ZServer{
+		Config:       c,
+		registry:     prometheus.NewRegistry(),
+		selfRegistry: prometheus.NewRegistry(),
+		limits:       newSeriesLimits(c.MetricsMaxSeries, c.MetricsMaxSeriesPerHost),
+
+		reservedNames: make(map[string]bool),
+	}
+	self := reservingRegisterer{s.selfRegistry, s.reservedNames}
+	converted := reservingRegisterer{s.registry, s.reservedNames}
+	self.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	s.selfMetrics = newServerMetrics(self, converted, c.MetricsNamespace)
+	if c.MetricsUnknownKeysCacheSize > 0 {
+		s.unknownKeys = newUnknownKeys(c.MetricsUnknownKeysCacheSize, c.MetricsUnknownKeysExposed, c.MetricsNamespace)
+		if c.MetricsUnknownKeysExposed > 0 {
+			self.MustRegister(s.unknownKeys)
+		}
+	}
+
+	return s
+}
+
+// Handler returns the HTTP handler serving the metrics endpoints
+func (s *ZServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	converted := prometheus.Gatherers{
+		s.registry,
+		prometheus.GathererFunc(s.gatherMetrics),
+	}
+	if s.Config.MetricsSelfPath == "" {
+		converted = append(converted, s.selfRegistry)
+	} else {
+		mux.Handle(s.Config.MetricsSelfPath, promhttp.HandlerFor(s.selfRegistry, promhttp.HandlerOpts{}))
+	}
+
+	var metricsHandler = promhttp.HandlerFor(converted, promhttp.HandlerOpts{})
+	if s.poller != nil {
+		metricsHandler = s.poller.scrapeHandler(metricsHandler)
+	}
+	mux.Handle(s.Config.MetricsPath, metricsHandler)
+
+	if s.Config.MetricsReloadEndpoint {
+		mux.HandleFunc("/-/reload", s.reloadHandler)
+	}
+	mux.HandleFunc("/-/series", s.seriesHandler)
+	if s.unknownKeys != nil {
+		mux.HandleFunc("/-/unknown-keys", s.unknownKeysHandler)
+	}
+
+	return mux
 }
 
 // Run starts the ZServer and listens on the server and metrics port
 func (s *ZServer) Run() error {
-	if err := s.loadMetricsFile(s.Config.MetricsFile); err != nil {
+	if err := s.reloadMetrics(); err != nil {
 		log.Fatalf("could not load metrics: %v", err)
 	}
 
+	go s.reloadOnSignal()
+	go s.expireSeriesPeriodically(seriesExpiryInterval)
+	if s.Config.MetricsReloadInterval > 0 {
+		go s.watchMetricsFile(s.Config.MetricsReloadInterval)
+	}
+
+	if s.Config.PollerFile != "" {
+		p, err := newPoller(s, s.Config.PollerFile)
+		if err != nil {
+			log.Fatalf("could not load poller targets: %v", err)
+		}
+		p.start()
+		s.poller = p
+	}
+
+	if s.Config.ProxyItemMapFile != "" {
+		items, err := loadProxyItems(s.Config.ProxyItemMapFile)
+		if err != nil {
+			log.Fatalf("could not load proxy item map: %v", err)
+		}
+		log.Infof("Loaded %d proxy items from %s", len(items), s.Config.ProxyItemMapFile)
+		s.proxyItems = items
+	}
+
 	// Start prom exporter
 	metricsListenIPPort := fmt.Sprintf("%s:%d",
 		s.Config.MetricsListenAddress,
 		s.Config.MetricsListenPort,
 	)
+	handler := s.Handler()
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-
 		log.Infof("Starting metrics server on %s", metricsListenIPPort)
-		log.Fatal(http.ListenAndServe(metricsListenIPPort, nil))
+		log.Fatal(http.ListenAndServe(metricsListenIPPort, handler))
 	}()
 
 	// Listen for incoming connections.
-	serverListenIPPort := fmt.Sprintf("%s:%d",
-		s.Config.ServerListenAddress,
-		s.Config.ServerListenPort,
-	)
-	l, err := net.Listen("tcp", serverListenIPPort)
-	if err != nil {
-		log.Fatalf("could not start listening: %v", err)
-	}
-	// Close the listener when the application closes.
-	defer l.Close()
-
-	log.Infof("Listening for zabbix sender requests on %s", serverListenIPPort)
-	for {
-		// Listen for an incoming connection.
-		conn, err := l.Accept()
+	var listeners []*listener
+	for _, c := range s.Config.Listeners {
+		l, err := s.listen(c)
 		if err != nil {
-			log.Fatalf("error accepting connection: %v", err)
+			log.Fatal(err)
 		}
-		// Handle connections in a new goroutine.
-		go s.handleRequest(conn)
+		listeners = append(listeners, l)
 	}
-}
-
-func (s *ZServer) checkIPAllowed(ip string) bool {
-	for _, i := range s.Config.ServerIPWhitelist {
-		if i.String() == ip {
-			return true
-		}
+	if len(listeners) == 0 {
+		log.Fatal("no listeners configured")
 	}
-	for _, c := range s.Config.ServerCIDRWhitelist {
-		if c.Contains(net.ParseIP(ip)) {
-			return true
-		}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			errs <- s.serve(l)
+		}(l)
 	}
-	return false
+	return <-errs
 }
 
 // Handles incoming requests.
-func (s *ZServer) handleRequest(conn net.Conn) {
+func (s *ZServer) handleRequest(l *listener, conn net.Conn) {
 	defer conn.Close()
 
 	// Check if IP is whitelisted
 	ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
-	if !s.checkIPAllowed(ip) {
+	if !l.config.checkIPAllowed(ip) {
 		log.WithFields(log.Fields{
 			"remote_ip": ip,
 		}).Warnf("connection from IP %s has been blocked", ip)
+		s.selfMetrics.connectionsBlocked.Inc()
 		return
 	}
+	s.selfMetrics.connectionsAccepted.Inc()
 
-	// read header
-	respHeader := make([]byte, 13)
+	if s.Config.ServerReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.Config.ServerReadTimeout))
+	}
+
+	if l.tls != nil {
+		c, err := l.tls.acceptConn(conn)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"remote_ip": ip,
+			}).Warnf("connection from IP %s has been rejected: %v", ip, err)
+			s.selfMetrics.connectionsFailed.Inc()
+			s.selfMetrics.requestsInvalid.Inc()
+			return
+		}
+		defer c.Close()
+		conn = c
+	}
 
-	headerLen, err := conn.Read(respHeader)
+	header, body, err := readZabbixPacket(conn, s.Config.ServerMaxBodySize)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"remote_ip": ip,
-		}).Errorf("Error reading header: %s", err.Error())
-		requestsInvalid.Inc()
+		}).Errorf("Error reading request: %s", err.Error())
+		s.selfMetrics.connectionsFailed.Inc()
+		s.selfMetrics.requestsInvalid.Inc()
 		return
 	}
+	start := time.Now()
+	s.selfMetrics.requestBodySize.Observe(float64(len(body)))
 
-	if headerLen != 13 {
+	var request Request
+	err = json.Unmarshal(body, &request)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"remote_ip": ip,
-		}).Errorln("Incorrect header len")
-		requestsInvalid.Inc()
+		}).Errorf("Error unmarshalling json: %s", err.Error())
+		s.selfMetrics.requestsInvalid.Inc()
 		return
 	}
 
-	if !bytes.HasPrefix(respHeader, []byte("ZBXD\x01")) {
+	var responseBody []byte
+	switch request.Request {
+	case "", requestSenderData, requestAgentData:
+		processed, total := s.processTrapperItems(ip, request.Data)
+		s.selfMetrics.requestItems.Observe(float64(total))
+		responseBody = zabbixResponse(processed, total-processed, total, time.Since(start).Seconds())
+	case requestProxyData:
+		processed, total, err := s.handleProxyData(ip, body)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"remote_ip": ip,
+			}).Errorf("Error processing proxy data: %s", err.Error())
+			s.selfMetrics.requestsInvalid.Inc()
+			responseBody = zabbixFailedResponse(err.Error())
+			break
+		}
 		log.WithFields(log.Fields{
 			"remote_ip": ip,
-		}).Errorln("Incorrect header prefix")
-		requestsInvalid.Inc()
-		return
+		}).Debugf("Processed proxy data from %s: processed: %d; total: %d", request.Host, processed, total)
+		s.selfMetrics.requestItems.Observe(float64(total))
+		responseBody = zabbixSuccessResponse()
+	case requestProxyHeartbeat:
+		s.selfMetrics.proxyLastSeen.WithLabelValues(request.Host).SetToCurrentTime()
+		responseBody = zabbixSuccessResponse()
+	case requestActiveChecks:
+		responseBody, err = zabbixActiveChecksResponse(s.activeChecks(request.Host))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"remote_ip": ip,
+			}).Errorf("could not build active checks response: %v", err)
+			return
+		}
+		log.WithFields(log.Fields{
+			"remote_ip": ip,
+		}).Debugf("Served active checks for host %s", request.Host)
+	default:
+		log.WithFields(log.Fields{
+			"remote_ip": ip,
+		}).Errorf("Unsupported request: %s", request.Request)
+		s.selfMetrics.requestsInvalid.Inc()
+		responseBody = zabbixFailedResponse(fmt.Sprintf("unsupported request: %s", request.Request))
 	}
 
-	body, err := ioutil.ReadAll(conn)
+	s.selfMetrics.requestDuration.Observe(time.Since(start).Seconds())
+
+	// reply using the same framing the client used
+	response, err := zabbixPacket(header.Flags, responseBody)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"remote_ip": ip,
-		}).Errorf("Error reading body: %s", err.Error())
-		requestsInvalid.Inc()
+		}).Errorf("could not build response: %v", err)
 		return
 	}
 
-	var request Request
-	err = json.Unmarshal(body, &request)
+	if s.Config.ServerWriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.Config.ServerWriteTimeout))
+	}
+
+	_, err = conn.Write(response)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"remote_ip": ip,
-		}).Errorf("Error unmarshalling json: %s", err.Error())
-		requestsInvalid.Inc()
-		return
+		}).Errorf("could not write response: %v", err)
+		s.selfMetrics.connectionsFailed.Inc()
 	}
+	s.selfMetrics.requestsProcessed.Inc()
+}
+
+// processTrapperItems applies trapper items to their metrics and returns the
+// number of processed and received items
+func (s *ZServer) processTrapperItems(ip string, items []TrapperItem) (int, int) {
+	received := time.Now()
+	metrics := s.currentMetrics()
 
 	var processed, total int
-	for _, trapperItem := range request.Data {
+	for _, trapperItem := range items {
 		total++
 
-		metric, ok := s.Metrics[trapperItem.Key()]
-		if !ok {
+		if trapperItem.State != 0 {
 			log.WithFields(log.Fields{
 				"remote_ip": ip,
-			}).Warnf("Skipping unknown metric: %s", trapperItem.FullKey)
-			trapperItemsSkipped.Inc()
+			}).Debugf("Skipping metric: %s (item not supported: %v)", trapperItem.FullKey, trapperItem.Value)
+			s.selfMetrics.trapperItemsSkipped.WithLabelValues(skipNotSupported).Inc()
 			continue
 		}
 
-		// calculate value
-		value, err := trapperItem.ParseFloat64()
+		key, err := trapperItem.ParseKey()
 		if err != nil {
 			log.WithFields(log.Fields{
 				"remote_ip": ip,
-			}).Warnf("Skipping metric: %s (%s)", trapperItem.Key(), err.Error())
-			trapperItemsSkipped.Inc()
+			}).Warnf("Skipping metric: %s", err.Error())
+			s.selfMetrics.trapperItemsSkipped.WithLabelValues(skipInvalidKey).Inc()
+			continue
+		}
+
+		// discovered items are also looked up when a static definition of
+		// the same key name rejects the args
+		metric, labels, known := metrics.lookup(key)
+		if metric == nil {
+			if m, l, ok := metrics.lookupDiscovered(trapperItem.Host, key); ok {
+				metric, labels, known = m, l, true
+			}
+		}
+		if !known {
+			s.skipUnknown(ip, trapperItem, key, received)
+			continue
+		}
+
+		if metric == nil {
+			log.WithFields(log.Fields{
+				"remote_ip": ip,
+			}).Warnf("Skipping metric: %s (invalid arg cardinality or values)", trapperItem.FullKey)
+			s.selfMetrics.trapperItemsSkipped.WithLabelValues(skipInvalidArgs).Inc()
 			continue
 		}
 
-		labels := append([]string{trapperItem.Host}, trapperItem.Args()...)
-		if len(labels) != len(metric.Args)+1 {
+		labels = append([]string{trapperItem.Host}, labels...)
+
+		ts := trapperItem.Timestamp(received)
+		if s.Config.MetricsMaxItemAge > 0 && received.Sub(ts) > s.Config.MetricsMaxItemAge {
 			log.WithFields(log.Fields{
 				"remote_ip": ip,
-			}).Warnf("Skipping metric: %s (invalid arg cardinality)", trapperItem.FullKey)
-			trapperItemsSkipped.Inc()
+			}).Warnf("Skipping metric: %s (clock %s exceeds max item age)", trapperItem.FullKey, ts.Format(time.RFC3339))
+			s.selfMetrics.trapperItemsSkipped.WithLabelValues(skipTooOld).Inc()
 			continue
 		}
 
-		switch strings.ToLower(metric.Kind) {
-		case "gauge":
-			metric.Gauge.WithLabelValues(labels...).Set(value)
-		case "counter":
-			if value < 0 {
-				log.WithFields(log.Fields{
-					"remote_ip": ip,
-				}).Warnf("Skipping metric: %s, received negative value for counter", metric.Metric)
-				trapperItemsSkipped.Inc()
+		if metric.discovery != nil {
+			if err := s.discover(metric, trapperItem.Host, trapperItem.Text(), received); err != nil {
+				s.logSkipped(ip, metric, err)
+				s.selfMetrics.trapperItemsSkipped.WithLabelValues(skipReason(err)).Inc()
+				continue
+			}
+		}
+
+		if metric.collector != nil {
+			if err := metric.update(labels, trapperItem.Text(), ts); err != nil {
+				s.logSkipped(ip, metric, err)
+				s.selfMetrics.trapperItemsSkipped.WithLabelValues(skipReason(err)).Inc()
+				continue
+			}
+		}
+
+		if len(metric.Dependent) > 0 {
+			applied, errs := metric.updateDependents(labels, trapperItem.Text(), ts)
+			for _, err := range errs {
+				s.logSkipped(ip, metric, err)
+			}
+			if applied == 0 {
+				reason := skipInvalidValue
+				if len(errs) > 0 {
+					reason = skipReason(errs[0])
+				}
+				s.selfMetrics.trapperItemsSkipped.WithLabelValues(reason).Inc()
 				continue
 			}
-			metric.Counter.WithLabelValues(labels...).Add(value)
 		}
 
 		processed++
-		trapperItemsProcessed.Inc()
+		s.selfMetrics.trapperItemsProcessed.WithLabelValues(metric.Metric).Inc()
 
 		log.WithFields(log.Fields{
 			"remote_ip": ip,
-		}).Debugf("Processed trapper request: Host: %s, Metric: %s, ZabbixKey: %s, Args: %s, Value: %f\n", trapperItem.Host, metric.Metric, metric.ZabbixKey, trapperItem.Args(), value)
+		}).Debugf("Processed trapper request: Host: %s, Metric: %s, ZabbixKey: %s, Args: %s, Value: %v\n", trapperItem.Host, metric.Metric, metric.ZabbixKey, key.Values(), trapperItem.Value)
 	}
 
-	_, err = conn.Write(zabbixResponse(processed, total-processed, total, 0))
-	if err != nil {
-		log.WithFields(log.Fields{
-			"remote_ip": ip,
-		}).Errorf("could not write response: %v", err)
+	return processed, total
+}
+
+// logSkipped logs why a value of metric was not applied and counts the
+// values rejected by series limits. Values discarded by preprocessing are
+// expected and only logged at debug level.
+func (s *ZServer) logSkipped(ip string, metric *Metric, err error) {
+	if limitErr, ok := err.(*seriesLimitError); ok {
+		s.selfMetrics.seriesLimitRejected.WithLabelValues(limitErr.limit).Inc()
+	}
+
+	entry := log.WithFields(log.Fields{
+		"remote_ip": ip,
+	})
+	if _, ok := err.(*discardedError); ok {
+		entry.Debugf("Skipping metric: %s (%s)", metric.Metric, err.Error())
+	} else {
+		entry.Warnf("Skipping metric: %s (%s)", metric.Metric, err.Error())
 	}
-	requestsProcessed.Inc()
 }
 
-func (s *ZServer) loadMetricsFile(file string) error {
-	metricsData, err := ioutil.ReadFile(file)
+// loadMetricsFiles builds the metric definitions of the files matched by
+// path. Definitions that did not change from previous are reused so they keep
+// their series.
+func (s *ZServer) loadMetricsFiles(path string, previous *metricSet) (*metricSet, error) {
+	files, err := readMetricsFiles(path)
 	if err != nil {
-		return fmt.Errorf("could not read file: %v", err)
+		return nil, fmt.Errorf("could not read metrics files: %v", err)
 	}
 
-	var metricsList []Metric
-	err = json.Unmarshal(metricsData, &metricsList)
-	if err != nil {
-		return fmt.Errorf("could not parse json: %v", err)
+	v := s.newMetricsValidator()
+	for _, f := range files {
+		v.validate(f)
+	}
+	if len(v.problems) > 0 {
+		return nil, fmt.Errorf("invalid metrics file:\n%v", v.problems)
 	}
 
-	var metricsMap = make(map[string]Metric)
-	for _, metric := range metricsList {
-		if metric.ZabbixKey == "" {
-			return fmt.Errorf("found empty ZabbixKey")
+	reusable := make(map[string]*Metric)
+	if previous != nil {
+		for _, metric := range previous.metrics {
+			reusable[metric.fingerprint] = metric
 		}
+	}
 
-		if metric.Metric == "" {
-			metric.Metric = sanitizeKey(metric.ZabbixKey)
+	var metrics = newMetricSet()
+	for _, f := range files {
+		for _, e := range f.elements {
+			fingerprint := f.fingerprint(e)
+
+			if metric, ok := reusable[fingerprint]; ok {
+				delete(reusable, fingerprint)
+				metrics.add(metric)
+				continue
+			}
+
+			metric := &Metric{fingerprint: fingerprint}
+			if err := json.Unmarshal(e.raw, metric); err != nil {
+				return nil, fmt.Errorf("could not parse json: %v", err)
+			}
+			f.defaults.apply(metric)
+
+			if err := s.initMetric(metric); err != nil {
+				return nil, err
+			}
+
+			metrics.add(metric)
+			log.Infof("Initialized metric %s from %s in %s", metric.Metric, metric.keyDescription(), f.path)
 		}
+	}
 
-		metricName := s.Config.MetricsNamespace + "_" + metric.Metric
-		switch strings.ToLower(metric.Kind) {
-		case "gauge":
-			metric.Gauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-				Name: metricName,
-				Help: metric.Help,
-			}, append([]string{"zabbix_sender_hostname"}, metric.Args...))
-		case "counter":
-			metric.Counter = promauto.NewCounterVec(prometheus.CounterOpts{
-				Name: metricName,
-				Help: metric.Help,
-			}, append([]string{"zabbix_sender_hostname"}, metric.Args...))
-		case "":
-			return fmt.Errorf("missing metric kind in config for metric %s", metric.Metric)
-		default:
-			return fmt.Errorf("invalid metric kind: %v", metric.Kind)
+	return metrics, nil
+}
+
+// metricName returns the exposed name of a metric
+func (s *ZServer) metricName(metric *Metric) string {
+	namespace := s.Config.MetricsNamespace
+	if metric.Namespace != "" {
+		namespace = metric.Namespace
+	}
+	return namespace + "_" + metric.Metric
+}
+
+// initMetric validates a metric definition and creates its collector
+func (s *ZServer) initMetric(metric *Metric) error {
+	if err := metric.initKeyPattern(); err != nil {
+		return fmt.Errorf("invalid key pattern for metric %s: %v", metric.Metric, err)
+	}
+
+	if metric.ZabbixKey == "" && metric.keyRegexp == nil {
+		return fmt.Errorf("found empty ZabbixKey")
+	}
+
+	if err := metric.initArgs(); err != nil {
+		return fmt.Errorf("invalid args for metric %s: %v", metric.Metric, err)
+	}
+
+	if metric.Metric == "" {
+		metric.Metric = sanitizeKey(metric.ZabbixKey)
+	}
+
+	if metric.Active != nil {
+		if err := metric.Active.init(metric); err != nil {
+			return fmt.Errorf("invalid active checks for metric %s: %v", metric.Metric, err)
 		}
+	}
 
-		metricsMap[metric.ZabbixKey] = metric
-		log.Infof("Initialized metric %s from zabbix key %s", metric.Metric, metric.ZabbixKey)
+	if len(metric.Prototypes) > 0 && strings.ToLower(metric.Kind) != kindDiscovery {
+		return fmt.Errorf("only discovery rules can define prototypes, metric %s is not one", metric.Metric)
 	}
 
-	s.Metrics = metricsMap
+	// discovery rules and metrics without kind only feed other metrics
+	if strings.ToLower(metric.Kind) == kindDiscovery {
+		if err := s.initDiscovery(metric); err != nil {
+			return err
+		}
+	} else if metric.Kind == "" && len(metric.Dependent) > 0 {
+		if len(metric.Preprocessing) > 0 || len(metric.ValueMap) > 0 {
+			return fmt.Errorf("metric %s without kind cannot define preprocessing or value_map", metric.Metric)
+		}
+	} else if err := s.initCollector(metric); err != nil {
+		return err
+	}
+
+	for i, dep := range metric.Dependent {
+		if err := s.initDependent(metric, dep); err != nil {
+			return fmt.Errorf("invalid dependent[%d] of metric %s: %v", i, metric.Metric, err)
+		}
+	}
 
 	return nil
 }
+
+// initCollector validates the kind specific settings of a metric and creates
+// its collector
+func (s *ZServer) initCollector(metric *Metric) error {
+	for i, step := range metric.Preprocessing {
+		if err := step.init(); err != nil {
+			return fmt.Errorf("invalid preprocessing[%d] for metric %s: %v", i, metric.Metric, err)
+		}
+	}
+
+	if err := metric.initTextKind(); err != nil {
+		return fmt.Errorf("invalid metric %s: %v", metric.Metric, err)
+	}
+
+	if metric.CounterMode != "" && strings.ToLower(metric.Kind) != "counter" {
+		return fmt.Errorf("counter_mode is only supported by counters, metric %s is a %s", metric.Metric, metric.Kind)
+	}
+
+	metricName := s.metricName(metric)
+	if s.reservedNames[metricName] {
+		return fmt.Errorf("metric name %s is reserved by the server metrics", metricName)
+	}
+	switch strings.ToLower(metric.Kind) {
+	case "gauge":
+		metric.Gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        metricName,
+			Help:        metric.Help,
+			ConstLabels: metric.Labels,
+		}, metric.labelNames())
+		metric.collector = metric.Gauge
+	case "counter":
+		switch metric.CounterMode {
+		case "":
+			metric.CounterMode = counterModeDelta
+		case counterModeDelta, counterModeAbsolute:
+		default:
+			return fmt.Errorf("invalid counter mode for metric %s: %s", metric.Metric, metric.CounterMode)
+		}
+		metric.Counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        metricName,
+			Help:        metric.Help,
+			ConstLabels: metric.Labels,
+		}, metric.labelNames())
+		metric.collector = metric.Counter
+	case "histogram":
+		if err := metric.checkReservedLabel("le"); err != nil {
+			return err
+		}
+		buckets, err := metric.histogramBuckets()
+		if err != nil {
+			return fmt.Errorf("invalid buckets for metric %s: %v", metric.Metric, err)
+		}
+		metric.Histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        metricName,
+			Help:        metric.Help,
+			ConstLabels: metric.Labels,
+			Buckets:     buckets,
+		}, metric.labelNames())
+		metric.collector = metric.Histogram
+	case "summary":
+		if err := metric.checkReservedLabel("quantile"); err != nil {
+			return err
+		}
+		objectives, err := metric.summaryObjectives()
+		if err != nil {
+			return fmt.Errorf("invalid objectives for metric %s: %v", metric.Metric, err)
+		}
+		maxAge, err := metric.summaryMaxAge()
+		if err != nil {
+			return fmt.Errorf("invalid summary for metric %s: %v", metric.Metric, err)
+		}
+		metric.Summary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:        metricName,
+			Help:        metric.Help,
+			ConstLabels: metric.Labels,
+			Objectives:  objectives,
+			MaxAge:      maxAge,
+		}, metric.labelNames())
+		metric.collector = metric.Summary
+	case "info", "stateset":
+		metric.Gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        metricName,
+			Help:        metric.Help,
+			ConstLabels: metric.Labels,
+		}, metric.labelNames())
+		metric.collector = metric.Gauge
+	case "":
+		return fmt.Errorf("missing metric kind in config for metric %s", metric.Metric)
+	default:
+		return fmt.Errorf("invalid metric kind: %v", metric.Kind)
+	}
+
+	metric.series = newSeriesTracker(s.limits)
+	if s.Config.MetricsHonorTimestamps {
+		metric.collector = &timestampCollector{metric: metric, vec: metric.collector}
+	}
+
+	if err := s.initStaleness(metric); err != nil {
+		return err
+	}
+	return s.initLimits(metric)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	log.SetLevel(log.PanicLevel)
+	os.Exit(m.Run())
+}
+
+// writeFile writes data to name in dir and returns its path
+func writeFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// tempDir returns a new temporary directory, callers remove it
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "zi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// newTestServer returns a ZServer with the YAML metric definitions loaded,
+// unless c sets the metrics file. The namespace defaults to zi.
+func newTestServer(t *testing.T, c *ZServerConfig, definitions string) *ZServer {
+	t.Helper()
+	if c == nil {
+		c = &ZServerConfig{}
+	}
+	if c.MetricsNamespace == "" {
+		c.MetricsNamespace = "zi"
+	}
+	if c.MetricsFile == "" {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		c.MetricsFile = writeFile(t, dir, "metrics.yaml", definitions)
+	}
+
+	s := NewZServer(c)
+	if err := s.reloadMetrics(); err != nil {
+		t.Fatalf("could not load metrics: %v", err)
+	}
+	return s
+}
+
+// item returns a trapper item sent by host with no clock
+func item(host, key string, value interface{}) TrapperItem {
+	return TrapperItem{Host: host, FullKey: key, Value: value}
+}
+
+// send processes items and checks how many were processed
+func send(t *testing.T, s *ZServer, processed int, items ...TrapperItem) {
+	t.Helper()
+	if got, total := s.processTrapperItems("127.0.0.1", items); got != processed || total != len(items) {
+		t.Fatalf("processed %d of %d items, want %d of %d", got, total, processed, len(items))
+	}
+}
+
+// gather returns the samples exposed on the metrics path of s by name and
+// sorted labels, e.g. zi_temp{id="a",zabbix_sender_hostname="h"}. Histograms
+// and summaries expose their count and sum.
+func gather(t *testing.T, s *ZServer) map[string]float64 {
+	t.Helper()
+	families, err := prometheus.Gatherers{
+		s.registry,
+		prometheus.GathererFunc(s.gatherMetrics),
+		s.selfRegistry,
+	}.Gather()
+	if err != nil {
+		t.Fatalf("could not gather metrics: %v", err)
+	}
+
+	samples := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.Metric {
+			pairs := make([]string, 0, len(m.Label))
+			for _, l := range m.Label {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			sort.Strings(pairs)
+			name := f.GetName()
+			if len(pairs) > 0 {
+				name += "{" + strings.Join(pairs, ",") + "}"
+			}
+
+			switch {
+			case m.Gauge != nil:
+				samples[name] = m.Gauge.GetValue()
+			case m.Counter != nil:
+				samples[name] = m.Counter.GetValue()
+			case m.Untyped != nil:
+				samples[name] = m.Untyped.GetValue()
+			case m.Histogram != nil:
+				samples[name+"_count"] = float64(m.Histogram.GetSampleCount())
+				samples[name+"_sum"] = m.Histogram.GetSampleSum()
+			case m.Summary != nil:
+				samples[name+"_count"] = float64(m.Summary.GetSampleCount())
+				samples[name+"_sum"] = m.Summary.GetSampleSum()
+			}
+		}
+	}
+	return samples
+}
+
+// expectSamples checks the value of samples, a missing sample being
+// expected with a NaN value
+func expectSamples(t *testing.T, s *ZServer, want map[string]float64) {
+	t.Helper()
+	samples := gather(t, s)
+	for name, value := range want {
+		got, ok := samples[name]
+		switch {
+		case math.IsNaN(value):
+			if ok {
+				t.Errorf("%s = %v, want no sample", name, got)
+			}
+		case !ok:
+			t.Errorf("%s is missing", name)
+		case got != value:
+			t.Errorf("%s = %v, want %v", name, got, value)
+		}
+	}
+}
+
+// skipped returns the number of items skipped for reason
+func skipped(t *testing.T, s *ZServer, reason string) float64 {
+	t.Helper()
+	return gather(t, s)[fmt.Sprintf(`zi_skipped_trapper_items{reason=%q}`, reason)]
+}
+
+func TestAbsoluteCounterReset(t *testing.T) {
+	s := newTestServer(t, nil, `
+- zabbix_key: requests
+  kind: counter
+  counter_mode: absolute
+- zabbix_key: errors
+  kind: counter`)
+
+	// 10 is lower than 150, the client total was reset and all of it is
+	// added
+	for _, v := range []string{"100", "150", "10", "30"} {
+		send(t, s, 2, item("h", "requests", v), item("h", "errors", v))
+	}
+	send(t, s, 0, item("h", "requests", "-1"))
+
+	expectSamples(t, s, map[string]float64{
+		`zi_requests{zabbix_sender_hostname="h"}`: 180,
+		`zi_errors{zabbix_sender_hostname="h"}`:   290,
+	})
+	if got := skipped(t, s, skipNegativeCounter); got != 1 {
+		t.Errorf("%v items skipped as negative counters, want 1", got)
+	}
+}
+
+func TestOverloadSelection(t *testing.T) {
+	s := newTestServer(t, nil, `
+- zabbix_key: vfs.fs.size
+  metric: fs_size_bytes
+  kind: gauge
+  args: [fs, mode]
+  defaults: {mode: total}
+- zabbix_key: vfs.fs.size
+  metric: fs_free_ratio
+  kind: gauge
+  args: [fs, mode]
+  match_args: {mode: pfree}
+- zabbix_key: net.if.in
+  metric: if_in_bytes
+  kind: gauge
+  args: [if]
+- zabbix_key: net.if.in
+  metric: if_in
+  kind: gauge
+  args: [if, mode]`)
+
+	send(t, s, 5,
+		item("h", "vfs.fs.size[/]", 10),
+		item("h", "vfs.fs.size[/,used]", 4),
+		item("h", "vfs.fs.size[/,pfree]", 60),
+		item("h", "net.if.in[eth0]", 1),
+		item("h", "net.if.in[eth0,packets]", 2),
+	)
+	send(t, s, 0, item("h", "net.if.in[eth0,packets,x]", 3))
+
+	expectSamples(t, s, map[string]float64{
+		// match_args is tried first even if defined after
+		`zi_fs_free_ratio{fs="/",zabbix_sender_hostname="h"}`: 60,
+		// defaults fill in the missing args
+		`zi_fs_size_bytes{fs="/",mode="total",zabbix_sender_hostname="h"}`: 10,
+		`zi_fs_size_bytes{fs="/",mode="used",zabbix_sender_hostname="h"}`:  4,
+		`zi_fs_size_bytes{fs="/",mode="pfree",zabbix_sender_hostname="h"}`: math.NaN(),
+		// the arity selects the definition
+		`zi_if_in_bytes{if="eth0",zabbix_sender_hostname="h"}`:          1,
+		`zi_if_in{if="eth0",mode="packets",zabbix_sender_hostname="h"}`: 2,
+		`zi_if_in{if="eth0",mode="",zabbix_sender_hostname="h"}`:        math.NaN(),
+	})
+	if got := skipped(t, s, skipInvalidArgs); got != 1 {
+		t.Errorf("%v items skipped for invalid args, want 1", got)
+	}
+}
+
+func TestExactKeyBeforePattern(t *testing.T) {
+	s := newTestServer(t, nil, `
+- zabbix_key_glob: "app.{name}.requests"
+  metric: app_requests
+  kind: gauge
+- zabbix_key_regex: 'app\.(?P<name>[a-z]+)\.[a-z]+'
+  metric: app_stat
+  kind: gauge
+- zabbix_key: app.web.requests
+  metric: web_requests
+  kind: gauge`)
+
+	send(t, s, 3,
+		item("h", "app.web.requests", 1),
+		item("h", "app.db.requests", 2),
+		item("h", "app.db.errors", 3),
+	)
+	// patterns match the whole key name
+	send(t, s, 0, item("h", "app.db.requests.total", 4))
+
+	expectSamples(t, s, map[string]float64{
+		// exact keys first, even if defined after the patterns
+		`zi_web_requests{zabbix_sender_hostname="h"}`:            1,
+		`zi_app_requests{name="web",zabbix_sender_hostname="h"}`: math.NaN(),
+		// then patterns in the order they are defined
+		`zi_app_requests{name="db",zabbix_sender_hostname="h"}`: 2,
+		`zi_app_stat{name="db",zabbix_sender_hostname="h"}`:     3,
+	})
+	if got := skipped(t, s, skipUnknownKey); got != 1 {
+		t.Errorf("%v items skipped as unknown, want 1", got)
+	}
+}
+
+func TestItemClock(t *testing.T) {
+	s := newTestServer(t, &ZServerConfig{
+		MetricsMaxItemAge:      time.Hour,
+		MetricsHonorTimestamps: true,
+	}, `
+- zabbix_key: temp
+  kind: gauge
+- zabbix_key: latency
+  kind: histogram
+  buckets: [1]`)
+
+	now := time.Now()
+	at := func(key string, value interface{}, ago time.Duration) TrapperItem {
+		it := item("h", key, value)
+		ts := now.Add(-ago)
+		it.Clock, it.NS = ts.Unix(), int64(ts.Nanosecond())
+		return it
+	}
+
+	send(t, s, 1, at("temp", 20, time.Minute))
+	send(t, s, 0, at("temp", 10, 2*time.Hour))
+	// older than the last applied value of the series
+	send(t, s, 0, at("temp", 30, 2*time.Minute))
+	// histograms observe every value
+	send(t, s, 2, at("latency", 0.5, time.Minute), at("latency", 2, 2*time.Minute))
+
+	expectSamples(t, s, map[string]float64{
+		`zi_temp{zabbix_sender_hostname="h"}`:          20,
+		`zi_latency{zabbix_sender_hostname="h"}_count`: 2,
+	})
+	if got := skipped(t, s, skipTooOld); got != 1 {
+		t.Errorf("%v items skipped as too old, want 1", got)
+	}
+	if got := skipped(t, s, skipOutOfOrder); got != 1 {
+		t.Errorf("%v items skipped as out of order, want 1", got)
+	}
+
+	// the samples are exposed with the item clock
+	families, err := s.gatherMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int64
+	for _, f := range families {
+		if f.GetName() == "zi_temp" {
+			got = f.Metric[0].GetTimestampMs()
+		}
+	}
+	if want := now.Add(-time.Minute).UnixNano() / int64(time.Millisecond); got != want {
+		t.Errorf("zi_temp timestamp = %d, want %d", got, want)
+	}
+}
+
+func TestServersDoNotShareMetrics(t *testing.T) {
+	definitions := `
+- zabbix_key: temp
+  kind: gauge`
+	a := newTestServer(t, nil, definitions)
+	b := newTestServer(t, nil, definitions)
+
+	send(t, a, 1, item("a", "temp", 1))
+	send(t, b, 2, item("b", "temp", 2), item("b", "temp", 3))
+	send(t, b, 0, item("b", "unknown", 4))
+
+	expectSamples(t, a, map[string]float64{
+		`zi_temp{zabbix_sender_hostname="a"}`:            1,
+		`zi_temp{zabbix_sender_hostname="b"}`:            math.NaN(),
+		`zi_processed_trapper_items{metric="temp"}`:      1,
+		`zi_skipped_trapper_items{reason="unknown_key"}`: 0,
+	})
+	expectSamples(t, b, map[string]float64{
+		`zi_temp{zabbix_sender_hostname="a"}`:            math.NaN(),
+		`zi_temp{zabbix_sender_hostname="b"}`:            3,
+		`zi_processed_trapper_items{metric="temp"}`:      2,
+		`zi_skipped_trapper_items{reason="unknown_key"}`: 1,
+	})
+}